@@ -43,11 +43,11 @@ run_server() {
 }
 
 run_client1() {
-	skds-client -f client1/client.conf
+	skds-client -f client1/client.conf -t "$TOKEN"
 }
 
 run_client2() {
-	skds-client -f client2/client.conf
+	skds-client -f client2/client.conf -t "$TOKEN"
 }
 
 # admin_firstrun username password installdir
@@ -75,6 +75,8 @@ admin_firstrun() {
 
 # admin_dir password
 register-clients() {
+	TOKEN="$(echo client token create --uses 2 | skds-admin -d $1 -p $2 | sed -n 's/^.*Token: //p')"
+
 	run_client1
 	run_client2
 
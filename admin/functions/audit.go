@@ -0,0 +1,80 @@
+package functions
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+func AuditQuery(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	var msg shared.Message
+	var err error
+
+	msg.Query.Actor = ctx.String("actor")
+	msg.Query.Secret = ctx.String("secret")
+	msg.Query.Limit = ctx.Int("limit")
+
+	if msg.Query.Limit < 0 {
+		cfg.Log(log.ERROR, "Limit cannot be negative")
+		return
+	}
+
+	msg.Query.Since, err = parseTime(ctx.String("since"), time.Now())
+	if err != nil {
+		cfg.Log(log.ERROR, "Invalid since:", err)
+		return
+	}
+
+	msg.Query.Until, err = parseTime(ctx.String("until"), time.Now())
+	if err != nil {
+		cfg.Log(log.ERROR, "Invalid until:", err)
+		return
+	}
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	cfg.Log(log.INFO, "Time\t\t\t\t", "Actor\t\t", "Address\t\t", "Code\t", "Endpoint\t\t", "Targets")
+	for i := range resp {
+		for _, e := range resp[i].Audit {
+			actor := e.Actor
+			if actor == "" {
+				actor = "-"
+			}
+			cfg.Log(log.INFO, time.Unix(e.Time, 0).Format(time.RFC1123), "\t", actor, "\t\t", e.Address, "\t",
+				e.Code, "\t", e.Endpoint, "\t\t", strings.Join(e.Targets, ", "))
+		}
+	}
+
+	return true
+}
+
+// parseTime converts a time given on the command line into a Unix time.
+// It may be a date, an RFC3339 time, or a duration before now.  An empty
+// string is returned as 0.
+func parseTime(s string, now time.Time) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return 0, fmt.Errorf("duration %s is negative", s)
+		}
+		return now.Add(-d).Unix(), nil
+	}
+
+	t, err := parseDate(s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
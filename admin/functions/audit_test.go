@@ -0,0 +1,40 @@
+package functions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in       string
+		expected int64
+		err      bool
+	}{
+		{"", 0, false},
+		{"24h", now.Add(-24 * time.Hour).Unix(), false},
+		{"2016-03-01T08:00:00Z", time.Date(2016, 3, 1, 8, 0, 0, 0, time.UTC).Unix(), false},
+		{"2016-03-01", time.Date(2016, 3, 1, 0, 0, 0, 0, time.Local).Unix(), false},
+		{"-1h", 0, true},
+		{"yesterday", 0, true},
+	}
+
+	for _, test := range tests {
+		res, err := parseTime(test.in, now)
+		if test.err {
+			if err == nil {
+				t.Error("Expected error parsing", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if res != test.expected {
+			t.Error("Parsing", test.in, "expected", test.expected, "got", res)
+		}
+	}
+}
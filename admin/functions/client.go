@@ -0,0 +1,249 @@
+package functions
+
+import (
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+func ClientTokenCreate(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	group := ctx.String("group")
+	uses := ctx.Int("uses")
+
+	expiry, err := time.ParseDuration(ctx.String("expiry"))
+	if err != nil {
+		cfg.Log(log.ERROR, "Invalid expiry:", err)
+		return
+	}
+
+	if uses < 1 {
+		cfg.Log(log.ERROR, "Uses must be at least 1")
+		return
+	}
+
+	if expiry < time.Second {
+		cfg.Log(log.ERROR, "Expiry must be at least 1s")
+		return
+	}
+
+	var msg shared.Message
+	msg.User.Group = group
+	msg.Token.Uses = uses
+	msg.Token.TTL = int(expiry / time.Second)
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	if len(resp) != 1 {
+		cfg.Log(log.ERROR, "Invalid response from server")
+		return
+	}
+
+	cfg.Log(log.INFO, "Token:", resp[0].Token.Token)
+	cfg.Log(log.INFO, "Valid for", resp[0].Token.Uses, "registrations until",
+		time.Unix(resp[0].Token.Expires, 0).Format(time.RFC1123))
+
+	if group != "" {
+		cfg.Log(log.INFO, "Clients will join group", group,
+			"but cannot read its secrets until given the group key with 'admin user group'")
+	}
+
+	return true
+}
+
+func ClientPendingList(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	resp, err := cfg.Session.Post(url, shared.Message{})
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	if len(resp) == 0 {
+		cfg.Log(log.INFO, "No clients are awaiting approval")
+		return true
+	}
+
+	cfg.Log(log.INFO, "Name\t\t\t", "Address\t\t\t", "Key fingerprint")
+	for i := range resp {
+		cfg.Log(log.INFO, resp[i].User.Name, "\t\t\t", resp[i].User.Address, "\t\t\t",
+			crypto.Fingerprint(resp[i].User.Key))
+	}
+
+	return true
+}
+
+func ClientPendingApprove(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	return pendingClient(cfg, ctx, url)
+}
+
+func ClientPendingReject(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	return pendingClient(cfg, ctx, url)
+}
+
+// pendingClient sends the name of a pending client to the server.
+func pendingClient(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Client name is required")
+		return
+	}
+
+	var msg shared.Message
+	msg.User.Name = name
+
+	_, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	return true
+}
+
+// ClientRekey re-encrypts the keys of a client's secrets for the keypair it
+// has rotated to.  Only a superuser can do this, as it needs the private key
+// of every secret assigned to the client, and of its group.
+func ClientRekey(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Client name is required")
+		return
+	}
+
+	var msg shared.Message
+	msg.User.Name = name
+
+	resp, err := cfg.Session.Post("/client/rekey/get", msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	if len(resp) != 1 || len(resp[0].User.Key) != 32 {
+		cfg.Log(log.ERROR, "Bad response from server")
+		return
+	}
+
+	cfg.Log(log.INFO, "Re-encrypting secrets of", name, "for key fingerprint",
+		crypto.Fingerprint(resp[0].User.Key))
+
+	var pubKey crypto.Key
+	pubKey.Pub = new([32]byte)
+	copy(pubKey.Pub[:], resp[0].User.Key)
+
+	msg.User.Key = resp[0].User.Key
+
+	for _, k := range resp[0].Keys {
+		privKey, err := secretPrivKey(cfg, k.Name)
+		if err != nil {
+			cfg.Log(log.ERROR, k.Name+":", err)
+			return
+		}
+
+		enc, err := crypto.Encrypt(privKey.Priv[:], cfg.Runtime.Keypair, &pubKey)
+		if err != nil {
+			// if Encrypt errored it may not have zeroed the data
+			privKey.Zero()
+			cfg.Log(log.ERROR, err)
+			return
+		}
+
+		msg.Keys = append(msg.Keys, shared.Key{Name: k.Name, Key: enc})
+	}
+
+	if resp[0].User.Group != "" {
+		privKey, err := groupPrivKey(cfg, resp[0].User.Group, false)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			return
+		}
+
+		msg.Key.GroupPriv, err = crypto.Encrypt(privKey.Priv[:], cfg.Runtime.Keypair, &pubKey)
+		if err != nil {
+			privKey.Zero()
+			cfg.Log(log.ERROR, "Unable to encrypt group key")
+			return
+		}
+	}
+
+	_, err = cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	cfg.Log(log.INFO, "Rekeyed", len(msg.Keys), "secrets")
+
+	return true
+}
+
+func ClientList(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	days := ctx.Int("days")
+
+	if days < 0 {
+		cfg.Log(log.ERROR, "Days must not be negative")
+		return
+	}
+
+	var msg shared.Message
+	if days > 0 {
+		msg.User.LastSeen = daysAgo(days)
+	}
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	cfg.Log(log.INFO, "Name\t\t\t", "Group\t\t", "Last seen\t\t\t", "Address\t\t", "Version")
+	for i := range resp {
+		seen := "never"
+		if resp[i].User.LastSeen != 0 {
+			seen = time.Unix(resp[i].User.LastSeen, 0).Format(time.RFC1123)
+		}
+		cfg.Log(log.INFO, resp[i].User.Name, "\t\t\t", resp[i].User.Group, "\t\t",
+			seen, "\t\t", resp[i].User.Address, "\t\t", resp[i].User.Version)
+	}
+
+	return true
+}
+
+func ClientPrune(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	days := ctx.Int("days")
+
+	if days < 1 {
+		cfg.Log(log.ERROR, "Days must be at least 1")
+		return
+	}
+
+	var msg shared.Message
+	msg.User.LastSeen = daysAgo(days)
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	for i := range resp {
+		cfg.Log(log.INFO, "Deleted", resp[i].User.Name)
+	}
+	cfg.Log(log.INFO, "Deleted", len(resp), "clients not seen for", days, "days")
+
+	return true
+}
+
+// daysAgo returns the Unix time the given number of days ago.
+func daysAgo(days int) int64 {
+	return time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+}
@@ -2,11 +2,77 @@ package functions
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/shared"
 )
 
+// parseMode parses an octal file mode.  An empty string is returned as 0,
+// which clients treat as the default mode.
+func parseMode(mode string) (uint32, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.New("Invalid file mode: " + mode)
+	}
+
+	return uint32(m), nil
+}
+
+// parseTags splits a comma separated list of tags.  Blank tags are dropped.
+func parseTags(list string) (tags []string) {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// parseDate parses a time given on the command line, as an RFC3339 time or
+// a date in the local time zone.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("%s is not a date, time or duration", s)
+	}
+	return t, nil
+}
+
+// parseExpiry converts an expiry date given on the command line into a Unix
+// time.  It may be a date, an RFC3339 time, or a duration after now.  An
+// empty string is returned as 0, meaning the secret does not expire.
+func parseExpiry(s string, now time.Time) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return 0, fmt.Errorf("duration %s is not positive", s)
+		}
+		return now.Add(d).Unix(), nil
+	}
+
+	t, err := parseDate(s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
 func superPubKey(cfg *shared.Config) (key crypto.Key, err error) {
 	resp, err := cfg.Session.Get("/key/public/get/super")
 	if err != nil {
@@ -178,9 +244,12 @@ func secretPrivKey(cfg *shared.Config, name string) (key crypto.Key, err error)
 	return
 }
 
-func secretGet(cfg *shared.Config, name string) (secret []byte, err error) {
+// secretGet downloads and decrypts a secret.  Version 0 is the current
+// version.
+func secretGet(cfg *shared.Config, name string, version int) (secret []byte, err error) {
 	var msg shared.Message
 	msg.Key.Name = name
+	msg.Key.Version = version
 
 	resp, err := cfg.Session.Post("/secret/get", msg)
 	if err != nil {
@@ -4,11 +4,79 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/shared"
 )
 
+func TestParseTags(t *testing.T) {
+	tags := parseTags(" prod, db,,team:payments ")
+	if len(tags) != 3 || tags[0] != "prod" || tags[1] != "db" || tags[2] != "team:payments" {
+		t.Error("Bad tags:", tags)
+	}
+
+	if tags = parseTags(""); len(tags) != 0 {
+		t.Error("Expected no tags, got", tags)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	exp, err := parseExpiry("720h", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp != now.Add(720*time.Hour).Unix() {
+		t.Error("Bad expiry for duration:", exp)
+	}
+
+	exp, err = parseExpiry("2016-06-01", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp != time.Date(2016, 6, 1, 0, 0, 0, 0, time.Local).Unix() {
+		t.Error("Bad expiry for date:", exp)
+	}
+
+	if exp, err = parseExpiry("", now); err != nil || exp != 0 {
+		t.Error("Empty expiry not returned as 0:", exp, err)
+	}
+
+	for _, in := range []string{"-24h", "0s", "next week"} {
+		if _, err = parseExpiry(in, now); err == nil {
+			t.Error("Invalid expiry accepted:", in)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	valid := map[string]uint32{
+		"":     0,
+		"0600": 0600,
+		"640":  0640,
+		"0777": 0777,
+	}
+
+	for in, exp := range valid {
+		mode, err := parseMode(in)
+		if err != nil {
+			t.Error(err)
+		}
+		if mode != exp {
+			t.Error("Bad mode for", in, "got", mode)
+		}
+	}
+
+	for _, in := range []string{"0800", "rw-r-----", "04755", "-1"} {
+		_, err := parseMode(in)
+		if err == nil {
+			t.Error("Invalid mode accepted:", in)
+		}
+	}
+}
+
 func TestSuperPubKey(t *testing.T) {
 	var resp shared.Message
 	resp.Key.Key = []byte("test data")
@@ -191,7 +259,7 @@ func TestSecretGet(t *testing.T) {
 
 	cfg.Session.New(cfg)
 
-	data, err := secretGet(cfg, exp.Key.Name)
+	data, err := secretGet(cfg, exp.Key.Name, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
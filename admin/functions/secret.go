@@ -3,6 +3,10 @@ package functions
 import (
 	"github.com/codegangsta/cli"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/log"
@@ -10,15 +14,27 @@ import (
 )
 
 func SecretList(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
-	resp, err := cfg.Session.Get(url)
+	var msg shared.Message
+	msg.Meta.Team = ctx.String("team")
+	msg.Meta.Tags = parseTags(ctx.String("tags"))
+
+	resp, err := cfg.Session.Post(url, msg)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		return
 	}
 
-	cfg.Log(log.INFO, "Secret name")
+	cfg.Log(log.INFO, "Secret name\t\t\t", "Team\t\t", "Tags\t\t", "Updated\t\t\t\t", "Description")
 	for i := range resp {
-		cfg.Log(log.INFO, resp[i].Key.Name)
+		meta := resp[i].Meta
+
+		updated := ""
+		if meta.Updated != 0 {
+			updated = time.Unix(meta.Updated, 0).Format(time.RFC1123) + " by " + meta.UpdatedBy
+		}
+
+		cfg.Log(log.INFO, resp[i].Key.Name, "\t\t\t", meta.Team, "\t\t", strings.Join(meta.Tags, ","), "\t\t",
+			updated, "\t", meta.Description)
 	}
 	return true
 }
@@ -35,6 +51,8 @@ func SecretListUser(cfg *shared.Config, ctx *cli.Context, url string) (ok bool)
 	var msg shared.Message
 	msg.User.Name = name
 	msg.User.Admin = admin
+	msg.Meta.Team = ctx.String("team")
+	msg.Meta.Tags = parseTags(ctx.String("tags"))
 
 	resp, err := cfg.Session.Post(url, msg)
 	if err != nil {
@@ -42,9 +60,10 @@ func SecretListUser(cfg *shared.Config, ctx *cli.Context, url string) (ok bool)
 		return
 	}
 
-	cfg.Log(log.INFO, "Secret name\t\t\tSecret Path")
+	cfg.Log(log.INFO, "Secret name\t\t\tSecret Path\t\t\tTeam\t\tTags")
 	for i := range resp {
-		cfg.Log(log.INFO, resp[i].Key.Name, "\t\t\t", resp[i].Key.Path)
+		cfg.Log(log.INFO, resp[i].Key.Name, "\t\t\t", resp[i].Key.Path, "\t\t\t", resp[i].Meta.Team, "\t\t",
+			strings.Join(resp[i].Meta.Tags, ","))
 	}
 
 	return true
@@ -62,6 +81,8 @@ func SecretListGroup(cfg *shared.Config, ctx *cli.Context, url string) (ok bool)
 	var msg shared.Message
 	msg.User.Group = name
 	msg.User.Admin = admin
+	msg.Meta.Team = ctx.String("team")
+	msg.Meta.Tags = parseTags(ctx.String("tags"))
 
 	resp, err := cfg.Session.Post(url, msg)
 	if err != nil {
@@ -69,9 +90,10 @@ func SecretListGroup(cfg *shared.Config, ctx *cli.Context, url string) (ok bool)
 		return
 	}
 
-	cfg.Log(log.INFO, "Secret name\t\t\tSecret Path")
+	cfg.Log(log.INFO, "Secret name\t\t\tSecret Path\t\t\tTeam\t\tTags")
 	for i := range resp {
-		cfg.Log(log.INFO, resp[i].Key.Name, "\t\t\t", resp[i].Key.Path)
+		cfg.Log(log.INFO, resp[i].Key.Name, "\t\t\t", resp[i].Key.Path, "\t\t\t", resp[i].Meta.Team, "\t\t",
+			strings.Join(resp[i].Meta.Tags, ","))
 	}
 
 	return true
@@ -93,6 +115,22 @@ func SecretNew(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
 
 	var msg shared.Message
 	msg.Key.Name = name
+	msg.Meta.Description = ctx.String("description")
+	msg.Meta.Tags = parseTags(ctx.String("tags"))
+	msg.Meta.Team = ctx.String("team")
+	msg.Meta.RotateDays = ctx.Int("rotate")
+
+	if msg.Meta.RotateDays < 0 {
+		cfg.Log(log.ERROR, "Rotation period cannot be negative")
+		return
+	}
+
+	expires, err := parseExpiry(ctx.String("expires"), time.Now())
+	if err != nil {
+		cfg.Log(log.ERROR, "Invalid expiry:", err)
+		return
+	}
+	msg.Meta.Expires = expires
 
 	superKey, err := superPubKey(cfg)
 	if err != nil {
@@ -207,11 +245,230 @@ func SecretUpdate(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
 	return true
 }
 
+func SecretGet(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+	version := ctx.Int("version")
+	file := ctx.String("file")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Secret name is required")
+		return
+	}
+
+	if version < 0 {
+		cfg.Log(log.ERROR, "Invalid version")
+		return
+	}
+
+	data, err := secretGet(cfg, name, version)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	defer crypto.Zero(data)
+
+	if file == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(file, data, 0600)
+	}
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	return true
+}
+
+func SecretEdit(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Secret name is required")
+		return
+	}
+
+	if !ctx.IsSet("description") && !ctx.IsSet("tags") && !ctx.IsSet("team") &&
+		!ctx.IsSet("expires") && !ctx.IsSet("rotate") {
+		cfg.Log(log.ERROR, "Nothing to change")
+		return
+	}
+
+	// An empty expiry removes it.
+	expires, err := parseExpiry(ctx.String("expires"), time.Now())
+	if err != nil {
+		cfg.Log(log.ERROR, "Invalid expiry:", err)
+		return
+	}
+
+	if ctx.Int("rotate") < 0 {
+		cfg.Log(log.ERROR, "Rotation period cannot be negative")
+		return
+	}
+
+	// The server replaces all of the metadata, so start from what is there.
+	var msg shared.Message
+	msg.Key.Name = name
+
+	resp, err := cfg.Session.Post("/secret/list/all", msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	if len(resp) != 1 {
+		cfg.Log(log.ERROR, "Secret does not exist")
+		return
+	}
+
+	msg.Meta = resp[0].Meta
+
+	if ctx.IsSet("description") {
+		msg.Meta.Description = ctx.String("description")
+	}
+	if ctx.IsSet("tags") {
+		msg.Meta.Tags = parseTags(ctx.String("tags"))
+	}
+	if ctx.IsSet("team") {
+		msg.Meta.Team = ctx.String("team")
+	}
+	if ctx.IsSet("expires") {
+		msg.Meta.Expires = expires
+	}
+	if ctx.IsSet("rotate") {
+		msg.Meta.RotateDays = ctx.Int("rotate")
+	}
+
+	_, err = cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	return true
+}
+
+func SecretExpiry(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	days := ctx.Int("days")
+
+	if days < 0 {
+		cfg.Log(log.ERROR, "Days cannot be negative")
+		return
+	}
+
+	now := time.Now()
+
+	var msg shared.Message
+	msg.Meta.Team = ctx.String("team")
+	msg.Meta.Tags = parseTags(ctx.String("tags"))
+	if days > 0 {
+		msg.Meta.Expires = now.AddDate(0, 0, days).Unix()
+	}
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	cfg.Log(log.INFO, "Secret name\t\t\t", "State\t\t", "Expires\t\t\t\t", "Team")
+	for i := range resp {
+		meta := resp[i].Meta
+		expires := time.Unix(meta.Expires, 0)
+
+		state := "expired"
+		if expires.After(now) {
+			state = "expiring"
+		}
+
+		cfg.Log(log.INFO, resp[i].Key.Name, "\t\t\t", state, "\t\t", expires.Format(time.RFC1123), "\t", meta.Team)
+	}
+
+	if days > 0 {
+		cfg.Log(log.INFO, len(resp), "secrets expired or expiring within", days, "days")
+	} else {
+		cfg.Log(log.INFO, len(resp), "secrets expired")
+	}
+
+	return true
+}
+
+func SecretHistory(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Secret name is required")
+		return
+	}
+
+	var msg shared.Message
+	msg.Key.Name = name
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	cfg.Log(log.INFO, "Version\t", "Stored\t\t\t\t", "By\t\t", "Hash")
+	for i := range resp {
+		for _, v := range resp[i].Versions {
+			version := strconv.Itoa(v.Version)
+			if v.Current {
+				version += " *"
+			}
+			cfg.Log(log.INFO, version, "\t", time.Unix(v.Time, 0).Format(time.RFC1123), "\t", v.Actor, "\t\t", v.Hash)
+		}
+	}
+
+	return true
+}
+
+func SecretRollback(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+	version := ctx.Int("version")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Secret name is required")
+		return
+	}
+
+	if version < 1 {
+		cfg.Log(log.ERROR, "Version is required")
+		return
+	}
+
+	var msg shared.Message
+	msg.Key.Name = name
+	msg.Key.Version = version
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	if len(resp) != 1 {
+		cfg.Log(log.ERROR, "Invalid response from server")
+		return
+	}
+
+	cfg.Log(log.INFO, "Restored version", version, "of", name, "as version", resp[0].Key.Version)
+
+	return true
+}
+
 func SecretAssignUser(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
 	name := ctx.String("name")
 	secret := ctx.String("secret")
 	path := ctx.String("path")
 	admin := ctx.Bool("admin")
+	owner := ctx.String("owner")
+	group := ctx.String("group")
+	command := ctx.String("command")
+	env := ctx.String("env")
+	sink := ctx.String("sink")
 
 	if name == "" {
 		cfg.Log(log.ERROR, "User name is required")
@@ -223,8 +480,14 @@ func SecretAssignUser(cfg *shared.Config, ctx *cli.Context, url string) (ok bool
 		return
 	}
 
-	if !admin && path == "" {
-		cfg.Log(log.ERROR, "Path is required when assigning a secret to a client")
+	if !admin && path == "" && env == "" {
+		cfg.Log(log.ERROR, "Path or env is required when assigning a secret to a client")
+		return
+	}
+
+	mode, err := parseMode(ctx.String("mode"))
+	if err != nil {
+		cfg.Log(log.ERROR, err)
 		return
 	}
 
@@ -233,6 +496,12 @@ func SecretAssignUser(cfg *shared.Config, ctx *cli.Context, url string) (ok bool
 	msg.User.Name = name
 	msg.User.Admin = admin
 	msg.Key.Path = path
+	msg.Key.Owner = owner
+	msg.Key.Group = group
+	msg.Key.Mode = mode
+	msg.Key.Command = command
+	msg.Key.Env = env
+	msg.Key.Sink = sink
 
 	pubKey, err := userPubKey(cfg, name, admin)
 	if err != nil {
@@ -268,6 +537,11 @@ func SecretAssignGroup(cfg *shared.Config, ctx *cli.Context, url string) (ok boo
 	secret := ctx.String("secret")
 	path := ctx.String("path")
 	admin := ctx.Bool("admin")
+	owner := ctx.String("owner")
+	group := ctx.String("group")
+	command := ctx.String("command")
+	env := ctx.String("env")
+	sink := ctx.String("sink")
 
 	if name == "" {
 		cfg.Log(log.ERROR, "Group name is required")
@@ -279,8 +553,14 @@ func SecretAssignGroup(cfg *shared.Config, ctx *cli.Context, url string) (ok boo
 		return
 	}
 
-	if !admin && path == "" {
-		cfg.Log(log.ERROR, "Path is required when assigning a secret to a client")
+	if !admin && path == "" && env == "" {
+		cfg.Log(log.ERROR, "Path or env is required when assigning a secret to a client")
+		return
+	}
+
+	mode, err := parseMode(ctx.String("mode"))
+	if err != nil {
+		cfg.Log(log.ERROR, err)
 		return
 	}
 
@@ -289,6 +569,12 @@ func SecretAssignGroup(cfg *shared.Config, ctx *cli.Context, url string) (ok boo
 	msg.User.Group = name
 	msg.User.Admin = admin
 	msg.Key.Path = path
+	msg.Key.Owner = owner
+	msg.Key.Group = group
+	msg.Key.Mode = mode
+	msg.Key.Command = command
+	msg.Key.Env = env
+	msg.Key.Sink = sink
 
 	pubKey, err := groupPubKey(cfg, name, admin)
 	if err != nil {
@@ -376,3 +662,43 @@ func SecretRemoveGroup(cfg *shared.Config, ctx *cli.Context, url string) (ok boo
 
 	return true
 }
+
+func SecretStatusList(cfg *shared.Config, ctx *cli.Context, url string) (ok bool) {
+	name := ctx.String("name")
+
+	if name == "" {
+		cfg.Log(log.ERROR, "Secret name is required")
+		return
+	}
+
+	var msg shared.Message
+	msg.Key.Name = name
+
+	resp, err := cfg.Session.Post(url, msg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+
+	cfg.Log(log.INFO, "Client\t\t\t", "State\t\t", "Path\t\t\t", "Reported\t\t\t", "Error")
+	for i := range resp {
+		for _, s := range resp[i].Status {
+			reported := "never"
+			if s.Time != 0 {
+				reported = time.Unix(s.Time, 0).Format(time.RFC1123)
+			}
+
+			var reason string
+			switch {
+			case s.Error != "":
+				reason = s.Error
+			case s.Hook == shared.StatusFailed:
+				reason = "hook failed"
+			}
+
+			cfg.Log(log.INFO, s.Client, "\t\t\t", s.State, "\t\t", s.Path, "\t\t\t", reported, "\t\t", reason)
+		}
+	}
+
+	return true
+}
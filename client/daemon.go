@@ -0,0 +1,207 @@
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/jfindley/skds/client/functions"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// Defaults used if the [client] config section does not set these.
+const (
+	defInterval   = 300 * time.Second
+	defMaxBackoff = 3600 * time.Second
+)
+
+// daemon polls the server for secrets until a signal is recieved.
+// A random jitter is added to every poll, so that a large number of clients
+// started at the same time do not all poll the server at once.
+func daemon(cfg *shared.Config, sigs chan os.Signal) {
+	interval := seconds(cfg.Startup.Client.Interval, defInterval)
+	maxBackoff := seconds(cfg.Startup.Client.MaxBackoff, defMaxBackoff)
+	jitter := seconds(cfg.Startup.Client.Jitter, 0)
+
+	rand.Seed(time.Now().UnixNano())
+
+	sync := functions.GetSecrets
+
+	if cfg.Startup.Client.Socket != "" {
+		agent, err := functions.NewAgent(cfg)
+		if err != nil {
+			cfg.Fatal("Unable to start agent:", err)
+		}
+		agent.Serve()
+		defer agent.Close()
+
+		sync = agent.Sync
+	}
+
+	cfg.Log(log.INFO, "Polling for secrets every", interval)
+
+	var failures uint
+
+	for {
+		if poll(cfg, sync) {
+			failures = 0
+		} else {
+			failures++
+		}
+
+		wait := backoff(interval, maxBackoff, failures)
+		if jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(jitter)))
+		}
+
+		cfg.Log(log.DEBUG, "Next poll in", wait)
+
+		watch := cfg.Startup.Client.Watch && failures == 0 && cfg.Session.Active()
+		if !sleep(cfg, sigs, wait, jitter, watch) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, returning false if a signal is recieved first.
+// If watch is set, the server is asked to tell us when our secrets change,
+// and we return early (after a random delay of up to jitter, so that all
+// clients do not fetch their secrets at once).
+// Each request rotates our session key, so nothing else may use the session
+// while a watch is in progress, and we do not return until it has finished.
+// The server is asked to end each watch by the time d is up, so that it never
+// needs cancelling, which loses the session.  Only a signal cancels one.
+func sleep(cfg *shared.Config, sigs chan os.Signal, d, jitter time.Duration, watch bool) bool {
+	type result struct {
+		changed bool
+		err     error
+	}
+
+	end := time.Now().Add(d)
+	deadline := time.After(d)
+
+	for watch {
+		// The server only accepts whole seconds.
+		remaining := time.Until(end)
+		if remaining < time.Second {
+			break
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan result, 1)
+		go func() {
+			changed, err := functions.Watch(ctx, cfg, remaining)
+			done <- result{changed, err}
+		}()
+
+		select {
+		case sig := <-sigs:
+			cfg.Log(log.INFO, "Recieved", sig, "shutting down")
+			cancel()
+			<-done
+			return false
+		case res := <-done:
+			cancel()
+			switch {
+			case res.err != nil:
+				cfg.Log(log.WARN, "Unable to watch for changes:", res.err)
+				watch = false
+			case res.changed:
+				cfg.Log(log.INFO, "Secrets have changed")
+				deadline = time.After(0)
+				if jitter > 0 {
+					deadline = time.After(time.Duration(rand.Int63n(int64(jitter))))
+				}
+				watch = false
+			}
+		}
+	}
+
+	select {
+	case sig := <-sigs:
+		cfg.Log(log.INFO, "Recieved", sig, "shutting down")
+		return false
+	case <-deadline:
+		return true
+	}
+}
+
+// poll logs in if required and fetches secrets with sync.  If the server has
+// expired our session since the last poll, we log in again and retry once.
+// If the server cannot be reached, cached secrets are applied, but the poll
+// still counts as a failure so that we back off until the server returns.
+func poll(cfg *shared.Config, sync func(*shared.Config) bool) bool {
+	defer func() {
+		cfg.Runtime.Offline = false
+	}()
+
+	if !cfg.Session.Active() {
+		cfg.Log(log.DEBUG, "Logging in")
+		err := login(cfg)
+		if err != nil {
+			cfg.Log(log.ERROR, "Login failed:", err)
+			if !shared.IsConnError(err) {
+				return false
+			}
+			cfg.Runtime.Offline = true
+		}
+	}
+
+	ok := sync(cfg)
+	if cfg.Runtime.Offline {
+		return false
+	}
+	if ok {
+		return true
+	}
+
+	if cfg.Session.Active() {
+		return false
+	}
+
+	cfg.Log(log.INFO, "Session expired, logging in again")
+	err := login(cfg)
+	if err != nil {
+		cfg.Log(log.ERROR, "Login failed:", err)
+		return false
+	}
+
+	return sync(cfg)
+}
+
+// login logs in with the password on disk, as it may have been replaced by
+// 'skds-client rotate' since we started.
+func login(cfg *shared.Config) error {
+	err := shared.Read(&cfg.Runtime.Password, cfg.Startup.Crypto.Password)
+	if err != nil {
+		return err
+	}
+	return functions.Login(cfg)
+}
+
+// backoff doubles the poll interval for every consecutive failure, up to
+// a maximum of max.
+func backoff(interval, max time.Duration, failures uint) time.Duration {
+	if max < interval {
+		max = interval
+	}
+	wait := interval
+	for i := uint(0); i < failures; i++ {
+		wait *= 2
+		if wait >= max {
+			return max
+		}
+	}
+	return wait
+}
+
+func seconds(value int, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return time.Duration(value) * time.Second
+}
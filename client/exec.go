@@ -0,0 +1,103 @@
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/jfindley/skds/client/functions"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// Signals that are passed on to the child in exec mode.
+var forwardSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+// execCommand fetches our secrets and runs args with them added to its
+// environment.  Signals we recieve are forwarded to the child, and its exit
+// status is returned so that we can exit with it.
+func execCommand(cfg *shared.Config, args []string) int {
+	err := functions.Login(cfg)
+	if shared.IsConnError(err) {
+		cfg.Log(log.ERROR, err)
+		cfg.Runtime.Offline = true
+	} else if err != nil {
+		cfg.Log(log.ERROR, err)
+		return 1
+	}
+
+	env, ok := functions.SecretEnv(cfg)
+
+	if !cfg.Runtime.Offline {
+		err = cfg.Session.Logout(cfg)
+		if err != nil {
+			cfg.Log(log.WARN, "Logout failed:", err)
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardSignals...)
+	defer signal.Stop(sigs)
+
+	err = cmd.Start()
+	if err != nil {
+		cfg.Log(log.ERROR, "Unable to run", args[0], err)
+		return 127
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case sig := <-sigs:
+			cfg.Log(log.DEBUG, "Forwarding", sig, "to", args[0])
+			cmd.Process.Signal(sig)
+		case err = <-done:
+			return exitStatus(cfg, err)
+		}
+	}
+}
+
+// exitStatus converts the error returned by a child process into the status
+// a shell would report for it.
+func exitStatus(cfg *shared.Config, err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+
+	cfg.Log(log.ERROR, err)
+	return 1
+}
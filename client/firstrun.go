@@ -15,6 +15,11 @@ import (
 
 func setup(cfg *shared.Config) (err error) {
 
+	if cfg.Startup.Client.Token == "" {
+		cfg.Log(log.WARN, "No enrollment token set, this client will need to be approved by an admin.\n",
+			"To register with a token, set Token in the [client] section or use -t.")
+	}
+
 	var success bool
 
 	// Remove all created files on exit if something goes wrong.
@@ -0,0 +1,231 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// Agent serves our decrypted secrets to local applications over a Unix
+// socket.  Secrets are held in memory, and replaced after every successful
+// sync with the server.
+//
+// GET /secrets lists the secrets the caller may read, and
+// GET /secrets/<name> returns the contents of a secret.
+//
+// The uid of the caller is checked with SO_PEERCRED.  Root, the user the
+// client runs as and the users listed in AgentUsers may use the agent.
+// A secret assigned with an owner may only be read by that user.
+type Agent struct {
+	cfg      *shared.Config
+	path     string
+	listener net.Listener
+	server   *http.Server
+	self     int
+	allowed  map[int]bool
+
+	mu      sync.RWMutex
+	secrets map[string]agentSecret
+}
+
+type agentSecret struct {
+	Name  string
+	Path  string `json:",omitempty"`
+	owner int    // -1 if any permitted user may read the secret
+	data  []byte
+}
+
+type peerKey struct{}
+
+// NewAgent creates the agent socket.  Any stale socket left behind by a
+// previous run is removed first.
+func NewAgent(cfg *shared.Config) (a *Agent, err error) {
+	if !peerCredSupported {
+		return nil, errors.New("The agent socket is not supported on this platform")
+	}
+
+	a = new(Agent)
+	a.cfg = cfg
+	a.path = cfg.Startup.Client.Socket
+	a.self = os.Getuid()
+	a.allowed = make(map[int]bool)
+	a.secrets = make(map[string]agentSecret)
+
+	for _, name := range cfg.Startup.Client.AgentUsers {
+		uid, err := lookupUser(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown agent user %s: %s", name, err)
+		}
+		a.allowed[uid] = true
+	}
+
+	fi, err := os.Lstat(a.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", a.path)
+	default:
+		err = os.Remove(a.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.listener, err = net.Listen("unix", a.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access is controlled by checking the uid of each connection, so any
+	// user must be able to connect.
+	err = os.Chmod(a.path, 0666)
+	if err != nil {
+		a.listener.Close()
+		return nil, err
+	}
+
+	a.server = &http.Server{
+		Handler: a,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			uid, err := peerUID(c)
+			if err != nil {
+				cfg.Log(log.WARN, "Unable to identify agent client:", err)
+				uid = -1
+			}
+			return context.WithValue(ctx, peerKey{}, uid)
+		},
+	}
+
+	return a, nil
+}
+
+// Serve accepts connections in the background until the agent is closed.
+func (a *Agent) Serve() {
+	a.cfg.Log(log.INFO, "Agent listening on", a.path)
+
+	go func() {
+		err := a.server.Serve(a.listener)
+		if err != nil && err != http.ErrServerClosed {
+			a.cfg.Log(log.ERROR, "Agent stopped:", err)
+		}
+	}()
+}
+
+// Close stops the agent, removes the socket and wipes the cached secrets.
+func (a *Agent) Close() error {
+	err := a.server.Close()
+	os.Remove(a.path)
+
+	a.mu.Lock()
+	for _, s := range a.secrets {
+		crypto.Zero(s.data)
+	}
+	a.secrets = make(map[string]agentSecret)
+	a.mu.Unlock()
+
+	return err
+}
+
+// Sync fetches our secrets and writes them to disk, as GetSecrets does, and
+// also updates the agent cache.
+func (a *Agent) Sync(cfg *shared.Config) (ok bool) {
+	return syncSecrets(cfg, a, new(Report))
+}
+
+// update replaces the cached secrets.  The data is copied, as the caller
+// zeroes its own copy once it is done with it.
+func (a *Agent) update(keys map[string]shared.Key, secrets map[string][]byte) {
+	cache := make(map[string]agentSecret)
+
+	for name, data := range secrets {
+		s := agentSecret{Name: name, Path: keys[name].Path, owner: -1}
+
+		if keys[name].Owner != "" {
+			uid, err := lookupUser(keys[name].Owner)
+			if err != nil {
+				a.cfg.Log(log.WARN, "Unknown owner of", name, "not serving it via the agent:", err)
+				continue
+			}
+			s.owner = uid
+		}
+
+		s.data = make([]byte, len(data))
+		copy(s.data, data)
+		cache[name] = s
+	}
+
+	a.mu.Lock()
+	for _, s := range a.secrets {
+		crypto.Zero(s.data)
+	}
+	a.secrets = cache
+	a.mu.Unlock()
+}
+
+func (a *Agent) permitted(uid int) bool {
+	return uid == 0 || uid == a.self || a.allowed[uid]
+}
+
+func (a *Agent) visible(s agentSecret, uid int) bool {
+	return s.owner == -1 || s.owner == uid || uid == 0 || uid == a.self
+}
+
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(peerKey{}).(int)
+	if !ok || !a.permitted(uid) {
+		a.cfg.Log(log.WARN, "Agent access denied to uid", uid)
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	switch {
+
+	case r.URL.Path == "/secrets":
+		list := []agentSecret{}
+		for _, s := range a.secrets {
+			if a.visible(s, uid) {
+				list = append(list, s)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case strings.HasPrefix(r.URL.Path, "/secrets/"):
+		name := strings.TrimPrefix(r.URL.Path, "/secrets/")
+
+		s, ok := a.secrets[name]
+		if !ok || !a.visible(s, uid) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+
+		a.cfg.Log(log.DEBUG, "Agent sent", name, "to uid", uid)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(s.data)
+
+	default:
+		http.Error(w, http.StatusText(404), 404)
+
+	}
+}
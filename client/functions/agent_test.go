@@ -0,0 +1,108 @@
+// +build linux
+
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Client.Socket = filepath.Join(dir, "agent.sock")
+	defer func() { cfg.Startup.Client.Socket = "" }()
+
+	agent, err := NewAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.Serve()
+	defer agent.Close()
+
+	keys := map[string]shared.Key{
+		"shared":  shared.Key{Name: "shared", Path: "/test/shared"},
+		"private": shared.Key{Name: "private", Owner: strconv.Itoa(os.Getuid())},
+	}
+	agent.update(keys, map[string][]byte{
+		"shared":  []byte("shared data"),
+		"private": []byte("private data"),
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", cfg.Startup.Client.Socket)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://agent/secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []agentSecret
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Error("Expected 2 secrets, got", len(list))
+	}
+
+	resp, err = client.Get("http://agent/secrets/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || string(data) != "shared data" {
+		t.Error("Bad response:", resp.StatusCode, string(data))
+	}
+
+	resp, err = client.Get("http://agent/secrets/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Error("Bad response code:", resp.StatusCode)
+	}
+
+	// Pretend to be an unprivileged user, to check access control.
+	agent.self = -2
+	defer func() { agent.self = os.Getuid() }()
+
+	if os.Getuid() != 0 {
+		resp, err = client.Get("http://agent/secrets/shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 403 {
+			t.Error("Unpermitted user allowed access:", resp.StatusCode)
+		}
+	}
+
+	s := agentSecret{owner: os.Getuid() + 1}
+	if agent.visible(s, os.Getuid()+2) {
+		t.Error("Secret visible to a user other than its owner")
+	}
+}
@@ -0,0 +1,127 @@
+package functions
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// secretCache is the last successful response to /client/secrets.  Secrets
+// are stored exactly as the server sent them, encrypted with our keypair, so
+// the cache is no more sensitive than the keypair itself.
+// The cache also lets us ask the server to only send our secrets if they have
+// changed since.
+type secretCache struct {
+	Time    int64  // Unix time the server last confirmed the secrets were current
+	ETag    string // Version of the secrets, as given by the server
+	Secrets []shared.Message
+}
+
+// Encode encodes a cache in JSON format.
+func (c *secretCache) Encode() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// Decode reads a JSON encoded cache.
+func (c *secretCache) Decode(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+// cachePath returns the location of the cache, or an empty string if there
+// is nowhere to store it.
+func cachePath(cfg *shared.Config) string {
+	if cfg.Startup.Crypto.Cache != "" {
+		return cfg.Startup.Crypto.Cache
+	}
+	if cfg.Startup.Dir != "" {
+		return filepath.Join(cfg.Startup.Dir, "cache.json")
+	}
+	return ""
+}
+
+// fetchSecrets gets our secrets from the server, and caches them.  If the
+// server reports they have not changed, the cached secrets are used.
+// If the server cannot be reached, or we already know it cannot, the cached
+// secrets are also returned, and cfg.Runtime.Offline is set.
+func fetchSecrets(cfg *shared.Config) (resp []shared.Message, err error) {
+	cache, cacheErr := loadCache(cfg)
+
+	if !cfg.Runtime.Offline {
+		var etag string
+		if cacheErr == nil {
+			etag = cache.ETag
+		}
+
+		var tag string
+		resp, tag, err = cfg.Session.GetChanged("/client/secrets", etag)
+		switch {
+		case err == nil:
+			saveCache(cfg, resp, tag)
+			return
+		case err == shared.ErrNotModified:
+			cfg.Log(log.DEBUG, "Secrets have not changed")
+			saveCache(cfg, cache.Secrets, cache.ETag)
+			return cache.Secrets, nil
+		case !shared.IsConnError(err):
+			return
+		}
+		cfg.Log(log.ERROR, err)
+		cfg.Runtime.Offline = true
+	}
+
+	if cacheErr != nil {
+		return nil, cacheErr
+	}
+
+	cfg.Log(log.WARN, "Server unreachable, using secrets cached at",
+		time.Unix(cache.Time, 0).Format(time.RFC1123))
+
+	return cache.Secrets, nil
+}
+
+// saveCache replaces the cache with resp.  Failing to save it is not fatal,
+// as the secrets have been fetched successfully.
+func saveCache(cfg *shared.Config, resp []shared.Message, etag string) {
+	path := cachePath(cfg)
+	if path == "" || cfg.Runtime.DryRun || cfg.Runtime.Exec {
+		return
+	}
+
+	cache := secretCache{Time: time.Now().Unix(), ETag: etag, Secrets: resp}
+
+	data, err := cache.Encode()
+	if err == nil {
+		err = writeFile(path, data, defaultAttrs)
+	}
+	if err != nil {
+		cfg.Log(log.WARN, "Unable to cache secrets:", err)
+	}
+}
+
+// loadCache reads the cache, returning an error if there is none or it is
+// older than the MaxCacheAge setting.
+func loadCache(cfg *shared.Config) (cache secretCache, err error) {
+	path := cachePath(cfg)
+	if path == "" {
+		return cache, errors.New("No cache location configured")
+	}
+
+	err = shared.Read(&cache, path)
+	if os.IsNotExist(err) {
+		return cache, errors.New("No cached secrets available")
+	} else if err != nil {
+		return
+	}
+
+	maxAge := time.Duration(cfg.Startup.Client.MaxCacheAge) * time.Second
+	if maxAge > 0 && time.Since(time.Unix(cache.Time, 0)) > maxAge {
+		return cache, errors.New("Cached secrets are older than MaxCacheAge, not using them")
+	}
+
+	return cache, nil
+}
@@ -0,0 +1,131 @@
+package functions
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestFetchSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.Cache = filepath.Join(dir, "cache.json")
+	defer func() {
+		cfg.Startup.Crypto.Cache = ""
+		cfg.Startup.Client.MaxCacheAge = 0
+		cfg.Runtime.Offline = false
+	}()
+
+	var msg shared.Message
+	msg.Key.Name = "cached secret"
+	msg.Key.Secret = []byte("encrypted data")
+
+	ts := testGet(200, msg)
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+	cfg.Session.New(cfg)
+
+	resp, err := fetchSecrets(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || cfg.Runtime.Offline {
+		t.Fatal("Secrets not fetched from the server")
+	}
+
+	fi, err := os.Stat(cfg.Startup.Crypto.Cache)
+	if err != nil {
+		t.Fatal("Cache not written:", err)
+	}
+	if fi.Mode().Perm() != fileMode {
+		t.Error("Bad cache mode:", fi.Mode().Perm())
+	}
+
+	ts.Close()
+
+	resp, err = fetchSecrets(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Runtime.Offline {
+		t.Error("Offline not set when using the cache")
+	}
+	if len(resp) != 1 || resp[0].Key.Name != msg.Key.Name || string(resp[0].Key.Secret) != "encrypted data" {
+		t.Error("Bad cached secrets:", resp)
+	}
+
+	cache := secretCache{Time: time.Now().Add(-2 * time.Hour).Unix(), Secrets: resp}
+	err = shared.Write(&cache, cfg.Startup.Crypto.Cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Startup.Client.MaxCacheAge = 3600
+
+	_, err = fetchSecrets(cfg)
+	if err == nil {
+		t.Error("Expired cache used")
+	}
+
+	os.Remove(cfg.Startup.Crypto.Cache)
+	cfg.Startup.Client.MaxCacheAge = 0
+
+	_, err = fetchSecrets(cfg)
+	if err == nil {
+		t.Error("No error without a cache")
+	}
+}
+
+func TestFetchSecretsNotModified(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.Cache = filepath.Join(dir, "cache.json")
+	defer func() {
+		cfg.Startup.Crypto.Cache = ""
+	}()
+
+	var requests, full int
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set(shared.HdrETag, `"1"`)
+		if r.Header.Get(shared.HdrIfNoneMatch) == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Write([]byte(`{"Key":{"Name":"unchanged secret"}}`))
+	}))
+	defer ts.Close()
+
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+	cfg.Session.New(cfg)
+
+	for i := 0; i < 2; i++ {
+		resp, err := fetchSecrets(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp) != 1 || resp[0].Key.Name != "unchanged secret" {
+			t.Error("Bad secrets:", resp)
+		}
+	}
+
+	if requests != 2 || full != 1 {
+		t.Error("Expected 1 full response of 2, got", full, "of", requests)
+	}
+}
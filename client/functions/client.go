@@ -5,8 +5,10 @@ package functions
 
 import (
 	"bytes"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/log"
@@ -55,122 +57,314 @@ func Register(cfg *shared.Config) (ok bool) {
 	msg.User.Admin = false
 	msg.User.Password = cfg.Runtime.Password
 	msg.User.Key = cfg.Runtime.Keypair.Pub[:]
+	msg.Token.Token = cfg.Startup.Client.Token
 
-	_, err := cfg.Session.Post("/client/register", msg)
+	resp, err := cfg.Session.Post("/client/register", msg)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		return
 	}
 
+	if len(resp) > 0 && resp[0].Response != "" {
+		cfg.Log(log.INFO, resp[0].Response)
+	}
+	cfg.Log(log.INFO, "Registered with key fingerprint", crypto.Fingerprint(cfg.Runtime.Keypair.Pub[:]))
+
 	return true
 }
 
+// errUpdateFailed is reported to the server when a secret file could not be
+// written.  The cause is logged on the client.
+var errUpdateFailed = errors.New("Unable to update file")
+
 func GetSecrets(cfg *shared.Config) (ok bool) {
-	resp, err := cfg.Session.Get("/client/secrets")
+	return syncSecrets(cfg, nil, new(Report))
+}
+
+// GetSecretsReport is GetSecrets, recording the outcome of the run in rep.
+func GetSecretsReport(cfg *shared.Config, rep *Report) (ok bool) {
+	return syncSecrets(cfg, nil, rep)
+}
+
+// syncSecrets fetches our secrets, writes them to disk and renders templates,
+// recording what was done in rep.  Each secret is applied independently, so
+// one that fails does not prevent the others being applied.
+// If agent is not nil, its cache is updated once every secret has been
+// decrypted.
+func syncSecrets(cfg *shared.Config, agent *Agent, rep *Report) (ok bool) {
+	rep.DryRun = cfg.Runtime.DryRun
+
+	resp, err := fetchSecrets(cfg)
 
 	if err != nil {
 		cfg.Log(log.ERROR, err)
+		rep.abort(err)
 		return
 	}
+	if cfg.Runtime.Offline {
+		rep.Login = LoginOffline
+	}
 	if len(resp) == 0 {
 		cfg.Log(log.INFO, "No secrets found")
-		return true
 	}
 
+	var changed hooks
+	current := make(manifest)
+
+	// Files whose secret could not be applied are left alone by cleanup.
+	failed := make(map[string]bool)
+
+	// The status of every secret we processed is reported once hooks have
+	// run.
+	var status statusReport
+	defer func() {
+		status.send(cfg, &changed)
+	}()
+
+	// Decrypted secrets are kept by name until templates have been rendered.
+	secrets := make(map[string][]byte)
+	keys := make(map[string]shared.Key)
+	defer func() {
+		for _, s := range secrets {
+			crypto.Zero(s)
+		}
+	}()
+
+	var decryptFailed bool
+
+	// Secrets are written once they have all been decrypted, as several may
+	// be assigned to the same file.
+	var files outputs
+
 	for _, r := range resp {
-		secretKey := new(crypto.Key)
-		secretKey.Priv = new([32]byte)
-
-		// If there is a group key, first decrypt that, and use it to
-		// decrypt the secret key.  Otherwise just decrypt the secret
-		// key directly.
-		if r.Key.GroupPriv != nil {
-
-			groupBuf, err := crypto.Decrypt(r.Key.GroupPriv, cfg.Runtime.Keypair)
-			if err != nil {
-				cfg.Log(log.ERROR, "Unable to decrypt group key:", err)
-				return
-			}
+		result := FileReport{Secret: r.Key.Name, Path: r.Key.Path}
 
-			groupKey := new(crypto.Key)
-			groupKey.Priv = new([32]byte)
+		secret, err := decryptSecret(cfg, r.Key, r.User.Key)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			status.add(r.Key, err)
+			rep.file(result, err)
+			failed[filepath.Clean(r.Key.Path)] = true
+			decryptFailed = true
+			continue
+		}
 
-			copy(groupKey.Priv[:], groupBuf)
-			crypto.Zero(groupBuf)
+		// The same secret may be assigned both directly and via a group.
+		if prev, ok := secrets[r.Key.Name]; ok {
+			crypto.Zero(secret)
+			secret = prev
+		}
+		secrets[r.Key.Name] = secret
+		keys[r.Key.Name] = r.Key
+
+		// Secrets without a path are only used in exec mode or templates.
+		if r.Key.Path == "" {
+			cfg.Log(log.DEBUG, "Secret", r.Key.Name, "has no path, not writing it")
+			status.add(r.Key, nil)
+			result.Action = actionSkip
+			rep.file(result, nil)
+			continue
+		}
 
-			buf, err := crypto.Decrypt(r.Key.Key, groupKey)
-			// No matter what happens, zero the group key at this point
-			groupKey.Zero()
-			if err != nil {
-				cfg.Log(log.ERROR, "Unable to decrypt secret key with group key:", err)
-				return
+		path, err := checkPath(cfg, r.Key.Path)
+		if err != nil {
+			cfg.Log(log.ERROR, "Refusing to write secret", r.Key.Name+":", err)
+			if cfg.Runtime.DryRun {
+				planned("reject", r.Key.Path, err.Error())
 			}
+			status.add(r.Key, err)
+			result.Action = actionReject
+			result.Error = err.Error()
+			rep.file(result, nil)
+			failed[filepath.Clean(r.Key.Path)] = true
+			continue
+		}
+		r.Key.Path = path
+		r.Key.Command = serverHook(cfg, r.Key)
 
-			copy(secretKey.Priv[:], buf)
-			crypto.Zero(buf)
+		files.add(r.Key, secret)
+	}
 
-		} else {
+	for _, f := range files.list {
+		if !writeOutput(cfg, f, current, &changed, &status, rep) {
+			failed[f.path] = true
+		}
+	}
 
-			buf, err := crypto.Decrypt(r.Key.Key, cfg.Runtime.Keypair)
-			if err != nil {
-				cfg.Log(log.ERROR, "Unable to decrypt secret key:", err)
-				return
-			}
+	// The agent keeps serving its previous secrets rather than losing some.
+	if agent != nil && !decryptFailed {
+		agent.update(keys, secrets)
+	}
+
+	renderTemplates(cfg, secrets, &changed, rep)
+
+	cleanup(cfg, current, failed, &changed, rep)
+
+	// Hooks for files that were written are run even if a later step failed,
+	// so that services are not left running with stale secrets.
+	changed.run(cfg)
+	rep.hooks(&changed)
+
+	// Secrets that could not be applied locally are reported to the server
+	// and in rep, but only a failure to reach the server fails the run.
+	return rep.Finish() != ResultFatal
+}
+
+// decryptSecret decrypts the secret in key with our keypair.  pub is the
+// public key the server says the secret was encrypted for.
+func decryptSecret(cfg *shared.Config, key shared.Key, pub []byte) (secret []byte, err error) {
+	keypair, err := keypairFor(cfg, pub)
+	if err != nil {
+		return
+	}
+	if keypair != cfg.Runtime.Keypair {
+		defer keypair.Zero()
+	}
+
+	secretKey := new(crypto.Key)
+	secretKey.Priv = new([32]byte)
+
+	// If there is a group key, first decrypt that, and use it to
+	// decrypt the secret key.  Otherwise just decrypt the secret
+	// key directly.
+	if key.GroupPriv != nil {
+
+		groupBuf, err := crypto.Decrypt(key.GroupPriv, keypair)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt group key: %s", err)
+		}
+
+		groupKey := new(crypto.Key)
+		groupKey.Priv = new([32]byte)
 
-			copy(secretKey.Priv[:], buf)
-			crypto.Zero(buf)
+		copy(groupKey.Priv[:], groupBuf)
+		crypto.Zero(groupBuf)
 
+		buf, err := crypto.Decrypt(key.Key, groupKey)
+		// No matter what happens, zero the group key at this point
+		groupKey.Zero()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt secret key with group key: %s", err)
 		}
 
-		// Now decrypt the secret itself.
-		secret, err := crypto.Decrypt(r.Key.Secret, secretKey)
-		// No matter what happens, zero the secret key at this point
-		secretKey.Zero()
+		copy(secretKey.Priv[:], buf)
+		crypto.Zero(buf)
 
+	} else {
+
+		buf, err := crypto.Decrypt(key.Key, keypair)
 		if err != nil {
-			cfg.Log(log.ERROR, "Unable to decrypt secret:", err)
-			return
+			return nil, fmt.Errorf("Unable to decrypt secret key: %s", err)
 		}
 
-		defer crypto.Zero(secret)
+		copy(secretKey.Priv[:], buf)
+		crypto.Zero(buf)
+
+	}
 
-		cfg.Log(log.DEBUG, "Processing file", r.Key.Path)
+	// Now decrypt the secret itself.
+	secret, err = crypto.Decrypt(key.Secret, secretKey)
+	// No matter what happens, zero the secret key at this point
+	secretKey.Zero()
 
-		curr, err := ioutil.ReadFile(r.Key.Path)
-		switch {
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt secret: %s", err)
+	}
 
-		case os.IsNotExist(err):
-			// We don't use the usual shared.Write method here because we want
-			// to write the raw secret to the disk, rather than encode it.
-			err = ioutil.WriteFile(r.Key.Path, secret, os.FileMode(0600))
-			if err != nil {
-				cfg.Log(log.ERROR, "Unable to write file:", err)
-				return
-			}
-			cfg.Log(log.INFO, "Created", r.Key.Path)
-			return true
-
-		case err != nil:
-			cfg.Log(log.ERROR, "Error opening file", r.Key.Path, err)
-			return
-
-		default:
-			if bytes.Compare(curr, secret) != 0 {
-				cfg.Log(log.INFO, "Updating", r.Key.Path)
-				// We don't use the usual shared.Write method here because we want
-				// to write the raw secret to the disk, rather than encode it.
-				err = ioutil.WriteFile(r.Key.Path, secret, os.FileMode(0600))
-				if err != nil {
-					cfg.Log(log.ERROR, "Unable to write file:", err)
-					return
-				}
-			} else {
-				cfg.Log(log.DEBUG, "File", r.Key.Path, "is up to date")
-			}
+	return
+}
+
+// updateFile writes data to key.Path if the file is missing or its contents
+// differ, and corrects its ownership and permissions otherwise.  Hooks for the
+// file are queued in changed if it was written.  The action taken is returned.
+// In a dry run, the action that would be taken is reported instead.
+func updateFile(cfg *shared.Config, key shared.Key, data []byte, changed *hooks) (action string, err error) {
+	cfg.Log(log.DEBUG, "Processing file", key.Path)
+
+	attrs, err := keyAttrs(key)
+	if err != nil {
+		return "", fmt.Errorf("Unable to look up owner of %s: %s", key.Path, err)
+	}
 
+	curr, err := readFile(key.Path)
+	defer crypto.Zero(curr)
+
+	switch {
+
+	case os.IsNotExist(err):
+		if cfg.Runtime.DryRun {
+			planned("create", key.Path, summary(data))
+			changed.add(cfg, key)
+			return actionCreate, nil
+		}
+		err = writeFile(key.Path, data, attrs)
+		if err != nil {
+			return "", fmt.Errorf("Unable to write file %s: %s", key.Path, err)
+		}
+		cfg.Log(log.INFO, "Created", key.Path)
+		changed.add(cfg, key)
+		return actionCreate, nil
+
+	case err != nil:
+		return "", fmt.Errorf("Error opening file %s: %s", key.Path, err)
+
+	case bytes.Compare(curr, data) != 0:
+		if cfg.Runtime.DryRun {
+			planned("update", key.Path, summary(curr)+" -> "+summary(data))
+			changed.add(cfg, key)
+			return actionUpdate, nil
 		}
+		cfg.Log(log.INFO, "Updating", key.Path)
+		err = writeFile(key.Path, data, attrs)
+		if err != nil {
+			return "", fmt.Errorf("Unable to write file %s: %s", key.Path, err)
+		}
+		changed.add(cfg, key)
+		return actionUpdate, nil
+
+	case cfg.Runtime.DryRun:
+		return plannedAttrs(key.Path, attrs)
+
+	default:
+		cfg.Log(log.DEBUG, "File", key.Path, "is up to date")
+
+		fixed, err := setAttrs(key.Path, attrs)
+		if err != nil {
+			return "", fmt.Errorf("Unable to set permissions on %s: %s", key.Path, err)
+		}
+		if fixed {
+			cfg.Log(log.INFO, "Updated permissions of", key.Path)
+			return actionFix, nil
+		}
+		return actionUnchanged, nil
 
 	}
+}
 
-	return true
+// plannedAttrs reports whether the permissions of an up to date file would
+// be changed.
+func plannedAttrs(path string, attrs fileAttrs) (action string, err error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", fmt.Errorf("Error opening file %s: %s", path, err)
+	}
+
+	owner, perm, err := checkAttrs(fi, attrs)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case owner && perm:
+		planned("unchanged", path, "ownership and mode would be corrected")
+	case owner:
+		planned("unchanged", path, "ownership would be corrected")
+	case perm:
+		planned("unchanged", path, fmt.Sprintf("mode would be set to %#o", attrs.mode))
+	default:
+		planned("unchanged", path, "")
+		return actionUnchanged, nil
+	}
+
+	return actionFix, nil
 }
@@ -74,6 +74,7 @@ func TestRegister(t *testing.T) {
 
 	cfg.Runtime.Password = []byte("test password")
 	cfg.Startup.NodeName = "test client"
+	cfg.Startup.Client.Token = "test token"
 
 	var expected shared.Message
 
@@ -81,6 +82,7 @@ func TestRegister(t *testing.T) {
 	expected.User.Admin = false
 	expected.User.Password = cfg.Runtime.Password
 	expected.User.Key = cfg.Runtime.Keypair.Pub[:]
+	expected.Token.Token = cfg.Startup.Client.Token
 
 	ts := testPost(expected, 204)
 	defer ts.Close()
@@ -0,0 +1,30 @@
+package functions
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// dryRunOutput is where the changes a dry run would make are reported.
+var dryRunOutput io.Writer = os.Stdout
+
+// SetDryRunOutput sets where the changes a dry run would make are reported.
+func SetDryRunOutput(w io.Writer) {
+	dryRunOutput = w
+}
+
+// planned reports an action that would have been taken on path, had this not
+// been a dry run.
+func planned(action, path, detail string) {
+	if detail != "" {
+		detail = " (" + detail + ")"
+	}
+	fmt.Fprintf(dryRunOutput, "%-10s %s%s\n", action, path, detail)
+}
+
+// summary describes file contents without revealing them.  Only a prefix of
+// the hash is shown, which is enough to tell versions apart.
+func summary(data []byte) string {
+	return fmt.Sprintf("%d bytes, sha256 %.12s", len(data), fileHash(data))
+}
@@ -0,0 +1,84 @@
+package functions
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	dryRunOutput = &out
+	cfg.Runtime.DryRun = true
+	cfg.Startup.Crypto.Manifest = filepath.Join(dir, "manifest.json")
+	defer func() {
+		dryRunOutput = os.Stdout
+		cfg.Runtime.DryRun = false
+		cfg.Startup.Crypto.Manifest = ""
+	}()
+
+	var created, updated, unchanged shared.Key
+	created.Path = filepath.Join(dir, "created")
+	updated.Path = filepath.Join(dir, "updated")
+	unchanged.Path = filepath.Join(dir, "unchanged")
+
+	for _, key := range []shared.Key{updated, unchanged} {
+		err = writeFile(key.Path, []byte("old secret"), defaultAttrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var h hooks
+	for _, key := range []shared.Key{created, updated} {
+		if _, err = updateFile(cfg, key, []byte("new secret"), &h); err != nil {
+			t.Fatal("Failed to process", key.Path, err)
+		}
+	}
+	if _, err = updateFile(cfg, unchanged, []byte("old secret"), &h); err != nil {
+		t.Fatal("Failed to process", unchanged.Path, err)
+	}
+
+	if _, err = os.Stat(created.Path); !os.IsNotExist(err) {
+		t.Error("File created in dry-run mode")
+	}
+	data, err := ioutil.ReadFile(updated.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(data, []byte("old secret")) != 0 {
+		t.Error("File updated in dry-run mode")
+	}
+
+	if !cleanup(cfg, make(manifest), nil, &h, new(Report)) {
+		t.Fatal("Cleanup failed")
+	}
+	if _, err = os.Stat(cfg.Startup.Crypto.Manifest); !os.IsNotExist(err) {
+		t.Error("Manifest written in dry-run mode")
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatal("Expected 3 lines of output, got", len(lines))
+	}
+	for i, action := range []string{"create", "update", "unchanged"} {
+		if !strings.HasPrefix(lines[i], action+" ") {
+			t.Error("Expected", action, "got", lines[i])
+		}
+	}
+
+	if strings.Contains(out.String(), "secret") {
+		t.Error("Secret contents included in output")
+	}
+}
@@ -0,0 +1,73 @@
+package functions
+
+import (
+	"strings"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// SecretEnv fetches and decrypts our secrets, returning them as environment
+// variables in NAME=value form.  Nothing is written to disk.
+func SecretEnv(cfg *shared.Config) (env []string, ok bool) {
+	resp, err := fetchSecrets(cfg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		return
+	}
+	if len(resp) == 0 {
+		cfg.Log(log.WARN, "No secrets found")
+	}
+
+	// The same secret may be assigned both directly and via a group, but two
+	// different secrets must not be exported with the same name.
+	names := make(map[string]string)
+
+	for _, r := range resp {
+		name := envName(r.Key)
+
+		if prev, exists := names[name]; exists {
+			if prev == r.Key.Name {
+				continue
+			}
+			cfg.Log(log.ERROR, "Secrets", prev, "and", r.Key.Name, "are both exported as", name)
+			return nil, false
+		}
+		names[name] = r.Key.Name
+
+		secret, err := decryptSecret(cfg, r.Key, r.User.Key)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			return nil, false
+		}
+
+		env = append(env, name+"="+string(secret))
+		crypto.Zero(secret)
+	}
+
+	return env, true
+}
+
+// envName returns the environment variable a secret is exported as.  Unless
+// one was given when the secret was assigned, this is the secret name in
+// upper case, with any characters not valid in a variable name replaced by
+// underscores.
+func envName(key shared.Key) string {
+	if key.Env != "" {
+		return key.Env
+	}
+
+	name := []byte(strings.ToUpper(key.Name))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		name = append([]byte{'_'}, name...)
+	}
+
+	return string(name)
+}
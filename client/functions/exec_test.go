@@ -0,0 +1,109 @@
+package functions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/shared"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		key      shared.Key
+		expected string
+	}{
+		{shared.Key{Name: "db-password"}, "DB_PASSWORD"},
+		{shared.Key{Name: "api.key"}, "API_KEY"},
+		{shared.Key{Name: "1st"}, "_1ST"},
+		{shared.Key{Name: "db-password", Env: "DB_PW"}, "DB_PW"},
+	}
+
+	for _, test := range tests {
+		if name := envName(test.key); name != test.expected {
+			t.Error("Expected", test.expected, "got", name)
+		}
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	cfg.NewClient()
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Runtime.Exec = true
+	cfg.Startup.Crypto.Cache = filepath.Join(dir, "cache.json")
+	defer func() {
+		cfg.Runtime.Exec = false
+		cfg.Startup.Crypto.Cache = ""
+	}()
+
+	// Skip TLS hostname verification
+	cfg.Runtime.CA = nil
+
+	err = cfg.Runtime.Keypair.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	super := new(crypto.Key)
+	super.Generate()
+
+	master := new(crypto.Key)
+	master.Generate()
+
+	masterSec, err := crypto.Encrypt([]byte("secret data"), super, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userKey, err := crypto.Encrypt(master.Priv[:], super, cfg.Runtime.Keypair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp shared.Message
+	resp.Key.Name = "test-secret"
+	resp.Key.Secret = masterSec
+	resp.Key.Key = userKey
+
+	ts := testGet(200, resp, resp)
+	defer ts.Close()
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+
+	cfg.Session.New(cfg)
+
+	env, ok := SecretEnv(cfg)
+	if !ok {
+		t.Fatal("Failed to get secrets")
+	}
+
+	if len(env) != 1 || env[0] != "TEST_SECRET=secret data" {
+		t.Error("Bad environment:", env)
+	}
+
+	if _, err = os.Stat(cfg.Startup.Crypto.Cache); !os.IsNotExist(err) {
+		t.Error("Cache written in exec mode")
+	}
+
+	conflict := resp
+	conflict.Key.Name = "test.secret"
+
+	ts2 := testGet(200, resp, conflict)
+	defer ts2.Close()
+	cfg.Startup.Address = strings.TrimPrefix(ts2.URL, "https://")
+
+	cfg.Session.New(cfg)
+
+	_, ok = SecretEnv(cfg)
+	if ok {
+		t.Error("Conflicting environment variable names accepted")
+	}
+}
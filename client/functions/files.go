@@ -0,0 +1,282 @@
+package functions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/jfindley/skds/shared"
+)
+
+const (
+	// Secret files are created with these permissions unless the assignment
+	// specifies otherwise.
+	fileMode = os.FileMode(0600)
+	// Missing parent directories of secret files are created with these permissions.
+	dirMode = os.FileMode(0700)
+)
+
+// fileAttrs are the ownership and permissions applied to a secret file.
+// A uid or gid of -1 leaves the owner or group unchanged.
+type fileAttrs struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+var defaultAttrs = fileAttrs{uid: -1, gid: -1, mode: fileMode}
+
+// keyAttrs looks up the local user and group a secret should be owned by.
+// Both names and numeric IDs are accepted.
+func keyAttrs(key shared.Key) (attrs fileAttrs, err error) {
+	attrs = defaultAttrs
+
+	if key.Mode != 0 {
+		attrs.mode = os.FileMode(key.Mode) & os.ModePerm
+	}
+
+	if key.Owner != "" {
+		attrs.uid, err = lookupUser(key.Owner)
+		if err != nil {
+			return
+		}
+	}
+
+	if key.Group != "" {
+		attrs.gid, err = lookupGroup(key.Group)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// lookupUser returns the uid of a local user, given either a name or an ID.
+func lookupUser(name string) (uid int, err error) {
+	uid, err = strconv.Atoi(name)
+	if err == nil {
+		return
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the gid of a local group, given either a name or an ID.
+func lookupGroup(name string) (gid int, err error) {
+	gid, err = strconv.Atoi(name)
+	if err == nil {
+		return
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// readFile reads the current contents of a secret file.  Symlinks are never
+// followed, as we will refuse to write to them anyway.
+func readFile(path string) (data []byte, err error) {
+	err = checkTarget(path)
+	if err != nil {
+		return
+	}
+	return ioutil.ReadFile(path)
+}
+
+// writeFile atomically replaces the file at path with data.
+// The data is written to a temporary file in the same directory, synced to
+// disk and then renamed over the target, so that a crash or a full disk never
+// leaves a truncated secret behind.  Because the rename replaces the directory
+// entry itself, a symlink planted at the target after we check it cannot
+// redirect the write.  Nor can a symlink among the parent directories, see
+// makeParents.
+// Ownership and permissions are set before the rename, so the secret is never
+// visible with the wrong permissions.
+func writeFile(path string, data []byte, attrs fileAttrs) (err error) {
+	err = checkTarget(path)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	dir := filepath.Dir(path)
+
+	err = makeParents(dir)
+	if err != nil {
+		return
+	}
+
+	// TempFile creates the file with mode 0600.
+	fh, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return
+	}
+
+	// Clean up the temporary file if anything goes wrong.
+	defer func() {
+		if err != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+		}
+	}()
+
+	_, err = fh.Write(data)
+	if err != nil {
+		return
+	}
+
+	if attrs.uid != -1 || attrs.gid != -1 {
+		err = fh.Chown(attrs.uid, attrs.gid)
+		if err != nil {
+			return
+		}
+	}
+
+	err = fh.Chmod(attrs.mode)
+	if err != nil {
+		return
+	}
+
+	err = fh.Sync()
+	if err != nil {
+		return
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(fh.Name(), path)
+	if err != nil {
+		return
+	}
+
+	return syncDir(dir)
+}
+
+// makeParents creates dir and any missing directories leading to it, checking
+// each one as it goes.  Symlinks are refused unless they are owned by root, so
+// that a link planted by another user in a directory they can write to cannot
+// send a secret elsewhere, while system links such as /var on darwin still
+// work.
+func makeParents(dir string) error {
+	dir = filepath.Clean(dir)
+
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		err := makeParents(parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	fi, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dir, dirMode)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		fi, err = os.Lstat(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid != 0 {
+			return fmt.Errorf("%s is a symlink not owned by root, refusing to follow it", dir)
+		}
+		fi, err = os.Stat(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// setAttrs corrects the ownership and permissions of an existing file,
+// returning true if anything was changed.
+func setAttrs(path string, attrs fileAttrs) (changed bool, err error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+
+	owner, perm, err := checkAttrs(fi, attrs)
+	if err != nil {
+		return
+	}
+
+	if owner {
+		err = os.Lchown(path, attrs.uid, attrs.gid)
+		if err != nil {
+			return
+		}
+	}
+
+	if perm {
+		err = os.Chmod(path, attrs.mode)
+		if err != nil {
+			return
+		}
+	}
+
+	return owner || perm, nil
+}
+
+// checkAttrs reports whether the ownership or permissions of a file differ
+// from attrs.
+func checkAttrs(fi os.FileInfo, attrs fileAttrs) (owner, perm bool, err error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, false, fmt.Errorf("Unable to read ownership of %s", fi.Name())
+	}
+
+	owner = (attrs.uid != -1 && attrs.uid != int(stat.Uid)) ||
+		(attrs.gid != -1 && attrs.gid != int(stat.Gid))
+	perm = fi.Mode().Perm() != attrs.mode
+
+	return
+}
+
+// checkTarget returns an error if path exists and is not a regular file.
+func checkTarget(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("%s is a symlink, refusing to follow it", path)
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	return nil
+}
+
+// syncDir flushes a directory to disk, so that a rename within it is durable.
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
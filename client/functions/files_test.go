@@ -0,0 +1,202 @@
+package functions
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subdir", "secret")
+
+	err = writeFile(path, []byte("first"), defaultAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != dirMode {
+		t.Error("Bad directory mode:", fi.Mode().Perm())
+	}
+
+	err = writeFile(path, []byte("second"), defaultAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(data, []byte("second")) != 0 {
+		t.Error("File contents do not match")
+	}
+
+	fi, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Error("Bad file mode:", fi.Mode().Perm())
+	}
+
+	// No temporary files should be left behind
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Error("Expected 1 file, found", len(files))
+	}
+}
+
+func TestWriteFileSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+
+	err = ioutil.WriteFile(target, []byte("original"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink(target, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeFile(link, []byte("secret"), defaultAttrs)
+	if err == nil {
+		t.Error("Wrote through a symlink")
+	}
+
+	_, err = readFile(link)
+	if err == nil {
+		t.Error("Read through a symlink")
+	}
+
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(data, []byte("original")) != 0 {
+		t.Error("Symlink target was modified")
+	}
+}
+
+func TestWriteFileSymlinkParent(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+
+	err = os.Mkdir(target, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink(target, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Links owned by root are trusted, so give it to someone else.
+	if os.Geteuid() == 0 {
+		err = os.Lchown(link, 65534, 65534)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = writeFile(filepath.Join(link, "sub", "secret"), []byte("secret"), defaultAttrs)
+	if err == nil {
+		t.Error("Wrote through a symlinked parent directory")
+	}
+
+	_, err = os.Stat(filepath.Join(target, "sub"))
+	if !os.IsNotExist(err) {
+		t.Error("Directory created through a symlinked parent")
+	}
+}
+
+func TestFileAttrs(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secret")
+
+	var key shared.Key
+	key.Owner = strconv.Itoa(os.Getuid())
+	key.Group = strconv.Itoa(os.Getgid())
+	key.Mode = 0640
+
+	attrs, err := keyAttrs(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attrs.uid != os.Getuid() || attrs.gid != os.Getgid() || attrs.mode != 0640 {
+		t.Error("Bad attributes:", attrs)
+	}
+
+	err = writeFile(path, []byte("secret"), defaultAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := setAttrs(path, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Permissions not changed")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Error("Bad file mode:", fi.Mode().Perm())
+	}
+
+	changed, err = setAttrs(path, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Permissions changed when already correct")
+	}
+
+	key.Owner = "no such user skds"
+	_, err = keyAttrs(key)
+	if err == nil {
+		t.Error("Invalid owner accepted")
+	}
+}
@@ -0,0 +1,146 @@
+package functions
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// Hooks that do not set a timeout are killed after this long.
+const defHookTimeout = 60 * time.Second
+
+var errHookTimeout = errors.New("Timed out")
+
+// hooks is the list of commands to run after secret files have changed.
+// Each command is only run once per sync, no matter how many changed files
+// it was queued for, so that services are not reloaded repeatedly.
+type hooks struct {
+	commands []string
+	seen     map[string]bool
+	paths    map[string][]string // Commands queued for each file
+	failed   map[string]bool     // Commands that did not succeed
+	ran      bool
+}
+
+// add queues the hooks for a changed file.  These may come from both the
+// secret assignment and the client config.
+func (h *hooks) add(cfg *shared.Config, key shared.Key) {
+	for _, cmd := range []string{key.Command, cfg.Startup.Client.Hooks[key.Path]} {
+		if cmd == "" {
+			continue
+		}
+		if h.seen == nil {
+			h.seen = make(map[string]bool)
+			h.paths = make(map[string][]string)
+		}
+		h.paths[key.Path] = append(h.paths[key.Path], cmd)
+		if h.seen[cmd] {
+			continue
+		}
+		h.seen[cmd] = true
+		h.commands = append(h.commands, cmd)
+	}
+}
+
+// serverHook returns the command set when key was assigned, if the client
+// config allows it to be run.  Anyone able to assign secrets could otherwise
+// run commands on every client they are assigned to.
+func serverHook(cfg *shared.Config, key shared.Key) string {
+	if key.Command == "" || cfg.Startup.Client.AllowServerHooks {
+		return key.Command
+	}
+	cfg.Log(log.WARN, "Not running hook for secret", key.Name+": AllowServerHooks is not enabled")
+	return ""
+}
+
+// run runs all queued hooks in the order they were added.  All hooks are run
+// even if some fail, and ok is only true if every hook succeeded.
+func (h *hooks) run(cfg *shared.Config) (ok bool) {
+	timeout := defHookTimeout
+	if cfg.Startup.Client.HookTimeout > 0 {
+		timeout = time.Duration(cfg.Startup.Client.HookTimeout) * time.Second
+	}
+
+	ok = true
+	h.ran = true
+	h.failed = make(map[string]bool)
+
+	for _, cmd := range h.commands {
+		if cfg.Runtime.DryRun {
+			planned("hook", cmd, "")
+			continue
+		}
+
+		cfg.Log(log.INFO, "Running hook:", cmd)
+
+		out, err := runHook(cmd, timeout)
+		if len(out) > 0 {
+			cfg.Log(log.DEBUG, strings.TrimSpace(string(out)))
+		}
+
+		if err != nil {
+			cfg.Log(log.ERROR, "Hook", cmd, "failed:", err)
+			h.failed[cmd] = true
+			ok = false
+			continue
+		}
+
+		cfg.Log(log.INFO, "Hook", cmd, "exited successfully")
+	}
+
+	return
+}
+
+// result returns the outcome of the hooks queued for a file: empty if none
+// were queued or they have not been run, otherwise shared.StatusFailed if any
+// of them failed and shared.StatusOK if not.
+func (h *hooks) result(path string) string {
+	if !h.ran || len(h.paths[path]) == 0 {
+		return ""
+	}
+	for _, cmd := range h.paths[path] {
+		if h.failed[cmd] {
+			return shared.StatusFailed
+		}
+	}
+	return shared.StatusOK
+}
+
+// runHook runs a command with the shell, killing it if it runs for longer
+// than timeout.  The combined output of the command is returned.
+// Hooks are run in their own process group, so that any children they start
+// are also killed on timeout.
+func runHook(command string, timeout time.Duration) (out []byte, err error) {
+	var buf bytes.Buffer
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = errHookTimeout
+	}
+
+	return buf.Bytes(), err
+}
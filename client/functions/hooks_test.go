@@ -0,0 +1,129 @@
+package functions
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestHooksAdd(t *testing.T) {
+	var h hooks
+	var key shared.Key
+
+	cfg.Startup.Client.Hooks = map[string]string{"/test/path1": "reload service"}
+	defer func() { cfg.Startup.Client.Hooks = nil }()
+
+	key.Path = "/test/path1"
+	key.Command = "reload service"
+	h.add(cfg, key)
+
+	key.Path = "/test/path2"
+	key.Command = "restart other"
+	h.add(cfg, key)
+
+	key.Path = "/test/path3"
+	key.Command = ""
+	h.add(cfg, key)
+
+	if len(h.commands) != 2 {
+		t.Fatal("Expected 2 hooks, got", len(h.commands))
+	}
+
+	if h.commands[0] != "reload service" || h.commands[1] != "restart other" {
+		t.Error("Hooks not in expected order:", h.commands)
+	}
+}
+
+func TestServerHook(t *testing.T) {
+	key := shared.Key{Name: "test", Path: "/test/path1", Command: "reload service"}
+
+	if serverHook(cfg, key) != "" {
+		t.Error("Server hook allowed by default")
+	}
+
+	cfg.Startup.Client.AllowServerHooks = true
+	defer func() { cfg.Startup.Client.AllowServerHooks = false }()
+
+	if serverHook(cfg, key) != "reload service" {
+		t.Error("Server hook not allowed when enabled")
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	out, err := runHook("echo test output", time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.TrimSpace(string(out)) != "test output" {
+		t.Error("Bad output:", string(out))
+	}
+
+	_, err = runHook("exit 3", time.Second)
+	if err == nil || err.Error() != "exit status 3" {
+		t.Error("Expected exit status 3, got", err)
+	}
+
+	start := time.Now()
+	_, err = runHook("sleep 10", 100*time.Millisecond)
+	if err != errHookTimeout {
+		t.Error("Expected timeout, got", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Hook not killed on timeout")
+	}
+}
+
+func TestHooksRun(t *testing.T) {
+	var h hooks
+	var key shared.Key
+
+	key.Command = "true"
+	h.add(cfg, key)
+
+	if !h.run(cfg) {
+		t.Error("Successful hook reported as failed")
+	}
+
+	key.Command = "false"
+	h.add(cfg, key)
+
+	if h.run(cfg) {
+		t.Error("Failed hook reported as successful")
+	}
+}
+
+func TestHooksResult(t *testing.T) {
+	var h hooks
+	var key shared.Key
+
+	key.Path = "/test/ok"
+	key.Command = "true"
+	h.add(cfg, key)
+
+	key.Path = "/test/failed"
+	key.Command = "false"
+	h.add(cfg, key)
+
+	// Shares a command with /test/ok, which is only run once.
+	key.Path = "/test/shared"
+	key.Command = "true"
+	h.add(cfg, key)
+
+	if h.result("/test/ok") != "" {
+		t.Error("Result reported before hooks were run")
+	}
+
+	h.run(cfg)
+
+	if h.result("/test/ok") != shared.StatusOK || h.result("/test/shared") != shared.StatusOK {
+		t.Error("Successful hook not reported")
+	}
+	if h.result("/test/failed") != shared.StatusFailed {
+		t.Error("Failed hook not reported")
+	}
+	if h.result("/test/none") != "" {
+		t.Error("Result reported for a file without hooks")
+	}
+}
@@ -0,0 +1,208 @@
+package functions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// Values for the Cleanup client setting.
+const (
+	cleanupRemove     = "remove"
+	cleanupQuarantine = "quarantine"
+	cleanupKeep       = "keep"
+)
+
+// manifest records the secret files we have written, by path, so that
+// files can be cleaned up once their secret is no longer assigned to us.
+type manifest map[string]manifestEntry
+
+type manifestEntry struct {
+	Name string // Name of the secret
+	Hash string // SHA-256 of the file contents, hex encoded
+}
+
+// Encode encodes a manifest in JSON format.
+func (m *manifest) Encode() ([]byte, error) {
+	return json.MarshalIndent(m, "", "\t")
+}
+
+// Decode reads a JSON encoded manifest.
+func (m *manifest) Decode(data []byte) error {
+	return json.Unmarshal(data, m)
+}
+
+func (m manifest) add(key shared.Key, data []byte) {
+	m[key.Path] = manifestEntry{Name: key.Name, Hash: fileHash(data)}
+}
+
+func fileHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// manifestPath returns the location of the manifest, or an empty string if
+// there is nowhere to store it.
+func manifestPath(cfg *shared.Config) string {
+	if cfg.Startup.Crypto.Manifest != "" {
+		return cfg.Startup.Crypto.Manifest
+	}
+	if cfg.Startup.Dir != "" {
+		return filepath.Join(cfg.Startup.Dir, "manifest.json")
+	}
+	return ""
+}
+
+// cleanup deals with every file in the previous manifest that is not in
+// current, according to the Cleanup setting, and then saves current as the
+// new manifest.  A dry run only reports what would be cleaned up.
+// Files that have been modified since we wrote them are left alone, as they
+// are no longer ours to remove.  Files we fail to clean up stay in the
+// manifest, so that we try again next time, as do the files in failed, whose
+// secrets are still assigned but could not be applied.
+func cleanup(cfg *shared.Config, current manifest, failed map[string]bool, changed *hooks, rep *Report) (ok bool) {
+	path := manifestPath(cfg)
+	if path == "" {
+		cfg.Log(log.DEBUG, "No manifest location configured, skipping cleanup")
+		return true
+	}
+
+	action := cfg.Startup.Client.Cleanup
+	switch action {
+	case "":
+		action = cleanupRemove
+	case cleanupRemove, cleanupQuarantine, cleanupKeep:
+	default:
+		cfg.Log(log.ERROR, "Invalid Cleanup setting:", action)
+		rep.fail(fmt.Errorf("Invalid Cleanup setting: %s", action))
+		return
+	}
+
+	previous := make(manifest)
+	err := shared.Read(&previous, path)
+	if err != nil && !os.IsNotExist(err) {
+		cfg.Log(log.ERROR, "Unable to read manifest:", err)
+		rep.fail(fmt.Errorf("Unable to read manifest: %s", err))
+		return
+	}
+
+	ok = true
+
+	for file, entry := range previous {
+		if _, exists := current[file]; exists {
+			continue
+		}
+		if failed[file] {
+			current[file] = entry
+			continue
+		}
+
+		result := FileReport{Secret: entry.Name, Path: file}
+
+		result.Action, err = cleanupFile(cfg, action, file, entry)
+		if err != nil {
+			cfg.Log(log.ERROR, "Unable to clean up", file, err)
+			rep.file(result, err)
+			current[file] = entry
+			ok = false
+			continue
+		}
+		if result.Action == "" {
+			continue
+		}
+		if result.Action != cleanupKeep {
+			changed.add(cfg, shared.Key{Path: file})
+		}
+		rep.file(result, nil)
+	}
+
+	if cfg.Runtime.DryRun {
+		return
+	}
+
+	data, err := current.Encode()
+	if err == nil {
+		err = writeFile(path, data, defaultAttrs)
+	}
+	if err != nil {
+		cfg.Log(log.ERROR, "Unable to write manifest:", err)
+		rep.fail(fmt.Errorf("Unable to write manifest: %s", err))
+		return false
+	}
+
+	return
+}
+
+// cleanupFile removes, quarantines or keeps a single file that is no longer
+// assigned to us, returning the action taken.  No action is returned if the
+// file has already gone.
+func cleanupFile(cfg *shared.Config, action, file string, entry manifestEntry) (taken string, err error) {
+	data, err := readFile(file)
+	if os.IsNotExist(err) {
+		cfg.Log(log.DEBUG, "Unassigned file", file, "has already been removed")
+		return "", nil
+	}
+	if err != nil {
+		return
+	}
+
+	if fileHash(data) != entry.Hash {
+		cfg.Log(log.WARN, file, "has been modified locally, not cleaning it up")
+		return cleanupKeep, nil
+	}
+
+	if cfg.Runtime.DryRun {
+		planned(action, file, summary(data))
+		return action, nil
+	}
+
+	switch action {
+
+	case cleanupKeep:
+		cfg.Log(log.INFO, "Secret", entry.Name, "is no longer assigned, keeping", file)
+		return cleanupKeep, nil
+
+	case cleanupQuarantine:
+		dir := cfg.Startup.Client.Quarantine
+		if dir == "" {
+			if cfg.Startup.Dir == "" {
+				return "", fmt.Errorf("No quarantine directory configured")
+			}
+			dir = filepath.Join(cfg.Startup.Dir, "quarantine")
+		}
+
+		err = os.MkdirAll(dir, dirMode)
+		if err != nil {
+			return
+		}
+
+		// Flatten the path so that files from different directories with
+		// the same name do not collide.
+		name := strings.Replace(strings.TrimPrefix(file, "/"), "/", "_", -1)
+		dest := filepath.Join(dir, name+"."+time.Now().Format("20060102150405"))
+
+		err = os.Rename(file, dest)
+		if err != nil {
+			return
+		}
+		cfg.Log(log.INFO, "Secret", entry.Name, "is no longer assigned, moved", file, "to", dest)
+
+	default:
+		err = os.Remove(file)
+		if err != nil {
+			return
+		}
+		cfg.Log(log.INFO, "Secret", entry.Name, "is no longer assigned, removed", file)
+
+	}
+
+	return action, syncDir(filepath.Dir(file))
+}
@@ -0,0 +1,107 @@
+package functions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.Manifest = filepath.Join(dir, "manifest.json")
+	cfg.Startup.Client.Quarantine = filepath.Join(dir, "quarantine")
+	defer func() {
+		cfg.Startup.Crypto.Manifest = ""
+		cfg.Startup.Client.Quarantine = ""
+		cfg.Startup.Client.Cleanup = ""
+	}()
+
+	var kept, removed, moved, modified shared.Key
+	kept.Path = filepath.Join(dir, "kept")
+	removed.Path = filepath.Join(dir, "removed")
+	moved.Path = filepath.Join(dir, "moved")
+	modified.Path = filepath.Join(dir, "modified")
+
+	current := make(manifest)
+	for _, key := range []shared.Key{kept, removed, moved, modified} {
+		err = writeFile(key.Path, []byte(key.Path), defaultAttrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current.add(key, []byte(key.Path))
+	}
+
+	var h hooks
+	if !cleanup(cfg, current, nil, &h, new(Report)) {
+		t.Fatal("Failed to write manifest")
+	}
+
+	err = ioutil.WriteFile(modified.Path, []byte("local changes"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current = make(manifest)
+	current.add(kept, []byte(kept.Path))
+	current.add(moved, []byte(moved.Path))
+
+	if !cleanup(cfg, current, nil, &h, new(Report)) {
+		t.Fatal("Cleanup failed")
+	}
+
+	if _, err = os.Stat(removed.Path); !os.IsNotExist(err) {
+		t.Error("Unassigned file was not removed")
+	}
+	if _, err = os.Stat(modified.Path); err != nil {
+		t.Error("Locally modified file was removed")
+	}
+	if _, err = os.Stat(kept.Path); err != nil {
+		t.Error("Assigned file was removed")
+	}
+
+	cfg.Startup.Client.Cleanup = cleanupQuarantine
+
+	current = make(manifest)
+	current.add(kept, []byte(kept.Path))
+
+	if !cleanup(cfg, current, nil, &h, new(Report)) {
+		t.Fatal("Cleanup failed")
+	}
+
+	if _, err = os.Stat(moved.Path); !os.IsNotExist(err) {
+		t.Error("Unassigned file was not quarantined")
+	}
+	files, err := ioutil.ReadDir(cfg.Startup.Client.Quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Error("Expected 1 quarantined file, found", len(files))
+	}
+
+	cfg.Startup.Client.Cleanup = cleanupKeep
+
+	if !cleanup(cfg, make(manifest), nil, &h, new(Report)) {
+		t.Fatal("Cleanup failed")
+	}
+	if _, err = os.Stat(kept.Path); err != nil {
+		t.Error("File was removed with cleanup disabled")
+	}
+
+	saved := make(manifest)
+	err = shared.Read(&saved, cfg.Startup.Crypto.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Error("Manifest not updated:", saved)
+	}
+}
@@ -0,0 +1,94 @@
+package functions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jfindley/skds/shared"
+)
+
+// checkPath returns the cleaned path a secret is assigned to, if it leads into
+// one of the AllowedPaths directories once symlinks are resolved.  The client
+// runs as root, so a compromised server must not be able to write anywhere.
+// If no AllowedPaths are configured, any absolute path is accepted.
+func checkPath(cfg *shared.Config, path string) (clean string, err error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("Path %s is not absolute", path)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("Path %s contains a parent directory reference", path)
+		}
+	}
+
+	clean = filepath.Clean(path)
+
+	roots := cfg.Startup.Client.AllowedPaths
+	if len(roots) == 0 {
+		return clean, nil
+	}
+
+	// Symlinks in the directories leading to the file would let it be written
+	// outside the allowed roots, so compare where it would really end up.
+	resolved, err := resolvePath(clean)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			continue
+		}
+		root, err = resolvePath(filepath.Clean(root))
+		if err != nil {
+			return "", err
+		}
+		if within(root, resolved) {
+			return clean, nil
+		}
+	}
+
+	return "", fmt.Errorf("Path %s is not within any of the allowed directories", path)
+}
+
+// resolvePath follows any symlinks in the directories leading to path.  Only
+// the part of the path that exists is resolved, and path itself is left alone,
+// as writeFile refuses to replace a symlink.
+func resolvePath(path string) (string, error) {
+	dir, file := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if file == "" {
+		return dir, nil
+	}
+
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			elems := append([]string{resolved}, missing...)
+			return filepath.Join(append(elems, file)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("Unable to resolve " + path)
+		}
+		missing = append([]string{filepath.Base(dir)}, missing...)
+		dir = parent
+	}
+}
+
+// within returns true if path is inside the directory root.  root itself does
+// not count, as a secret cannot be written over a directory.
+func within(root, path string) bool {
+	if root == string(filepath.Separator) {
+		return path != root
+	}
+	return strings.HasPrefix(path, root+string(filepath.Separator))
+}
@@ -0,0 +1,69 @@
+package functions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestCheckPath(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	allowed := filepath.Join(dir, "allowed")
+	err = os.Mkdir(allowed, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(dir, filepath.Join(allowed, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := new(shared.Config)
+
+	clean, err := checkPath(cfg, "/etc//shadow")
+	if err != nil {
+		t.Error("Path rejected with no AllowedPaths:", err)
+	}
+	if clean != "/etc/shadow" {
+		t.Error("Path not cleaned:", clean)
+	}
+
+	cfg.Startup.Client.AllowedPaths = []string{allowed}
+
+	good := []string{
+		filepath.Join(allowed, "secret"),
+		filepath.Join(allowed, "new", "dir", "secret"),
+		allowed + "/./secret",
+	}
+	for _, path := range good {
+		_, err = checkPath(cfg, path)
+		if err != nil {
+			t.Error("Allowed path rejected:", err)
+		}
+	}
+
+	bad := []string{
+		"relative/secret",
+		"/etc/shadow",
+		allowed,
+		allowed + "/../secret",
+		allowed + "/sub/../secret",
+		allowed + "-other/secret",
+		filepath.Join(allowed, "escape", "secret"),
+		filepath.Join(allowed, "escape", "new", "secret"),
+	}
+	for _, path := range bad {
+		_, err = checkPath(cfg, path)
+		if err == nil {
+			t.Error("Path not rejected:", path)
+		}
+	}
+}
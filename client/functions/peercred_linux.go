@@ -0,0 +1,37 @@
+package functions
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const peerCredSupported = true
+
+// peerUID returns the uid of the process on the other end of a Unix socket.
+func peerUID(conn net.Conn) (uid int, err error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("Not a Unix socket")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+
+	return int(cred.Uid), nil
+}
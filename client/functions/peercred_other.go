@@ -0,0 +1,16 @@
+// +build !linux
+
+package functions
+
+import (
+	"errors"
+	"net"
+)
+
+// Peer credentials are only implemented on Linux, so the agent is
+// unavailable elsewhere.
+const peerCredSupported = false
+
+func peerUID(conn net.Conn) (uid int, err error) {
+	return -1, errors.New("Peer credentials are not supported on this platform")
+}
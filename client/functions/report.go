@@ -0,0 +1,134 @@
+package functions
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/jfindley/skds/shared"
+)
+
+// Outcomes of logging in, as given in a Report.
+const (
+	LoginOK      = "ok"
+	LoginOffline = "offline" // The server could not be reached, cached secrets were used
+	LoginFailed  = "failed"
+)
+
+// Overall results of a run, as given in a Report.
+const (
+	ResultUnchanged = "unchanged" // Nothing needed changing
+	ResultChanged   = "changed"   // Changes were applied, with no failures
+	ResultPartial   = "partial"   // Some files or hooks failed
+	ResultFatal     = "fatal"     // Nothing could be applied
+)
+
+// Actions taken on a file, as given in a Report.  In a dry run, they are the
+// actions that would have been taken.
+const (
+	actionCreate    = "create"
+	actionUpdate    = "update"
+	actionFix       = "fix" // Ownership or permissions were corrected
+	actionUnchanged = "unchanged"
+	actionSkip      = "skip" // Secrets with no path are not written
+	actionReject    = "reject"
+	actionFail      = "fail"
+	// Files that are no longer assigned use the Cleanup setting as their action.
+)
+
+// Report is the outcome of a run of the client, for tools that wrap it.
+type Report struct {
+	Login  string       // LoginOK, LoginOffline or LoginFailed
+	DryRun bool         `json:",omitempty"`
+	Result string       // Set by Finish
+	Files  []FileReport `json:",omitempty"`
+	Errors []string     `json:",omitempty"` // Errors not specific to a file
+
+	fatal bool
+}
+
+// FileReport is the outcome of processing a single secret, template or
+// unassigned file.
+type FileReport struct {
+	Secret   string `json:",omitempty"`
+	Template string `json:",omitempty"` // Source of the template
+	Path     string `json:",omitempty"`
+	Action   string
+	Error    string `json:",omitempty"`
+	Hook     string `json:",omitempty"` // shared.StatusOK or shared.StatusFailed, if a hook ran
+}
+
+// file records the outcome of processing a file.  If err is not nil, the
+// action is recorded as a failure.
+func (r *Report) file(f FileReport, err error) {
+	if err != nil {
+		f.Action = actionFail
+		f.Error = err.Error()
+	}
+	r.Files = append(r.Files, f)
+}
+
+// fail records an error that is not specific to a file.
+func (r *Report) fail(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// abort records an error that prevented anything being applied.
+func (r *Report) abort(err error) {
+	r.fail(err)
+	r.fatal = true
+}
+
+// hooks fills in the result of the hooks run for each file.
+func (r *Report) hooks(h *hooks) {
+	for i := range r.Files {
+		if r.Files[i].Path != "" {
+			r.Files[i].Hook = h.result(r.Files[i].Path)
+		}
+	}
+}
+
+// Finish sets the overall result of the run, and returns it.
+func (r *Report) Finish() string {
+	r.Result = ResultUnchanged
+
+	if r.fatal || r.Login == LoginFailed {
+		r.Result = ResultFatal
+		return r.Result
+	}
+
+	if len(r.Errors) > 0 {
+		r.Result = ResultPartial
+	}
+
+	for _, f := range r.Files {
+		switch {
+		case f.Action == actionFail || f.Action == actionReject || f.Hook == shared.StatusFailed:
+			r.Result = ResultPartial
+		case r.Result == ResultUnchanged && changedAction(f.Action):
+			r.Result = ResultChanged
+		}
+	}
+
+	return r.Result
+}
+
+// changedAction returns true if action changes a file.
+func changedAction(action string) bool {
+	switch action {
+	case actionCreate, actionUpdate, actionFix, cleanupRemove, cleanupQuarantine:
+		return true
+	}
+	return false
+}
+
+// Write finishes the report, and writes it to w in JSON format.
+func (r *Report) Write(w io.Writer) error {
+	r.Finish()
+
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,166 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/shared"
+)
+
+func TestGetSecretsReport(t *testing.T) {
+	cfg.NewClient()
+
+	// Skip TLS hostname verification
+	cfg.Runtime.CA = nil
+
+	err := cfg.Runtime.Keypair.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.Manifest = filepath.Join(dir, "manifest.json")
+	cfg.Startup.Crypto.Cache = filepath.Join(dir, "cache.json")
+	defer func() {
+		cfg.Startup.Crypto.Manifest = ""
+		cfg.Startup.Crypto.Cache = ""
+		cfg.Runtime.Offline = false
+	}()
+
+	super := new(crypto.Key)
+	super.Generate()
+
+	master := new(crypto.Key)
+	master.Generate()
+
+	masterSec, err := crypto.Encrypt([]byte("secret data"), super, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userKey, err := crypto.Encrypt(master.Priv[:], super, cfg.Runtime.Keypair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bad, good shared.Message
+	bad.Key.Name = "bad"
+	bad.Key.Path = filepath.Join(dir, "bad")
+	bad.Key.Secret = masterSec
+	bad.Key.Key = []byte("not a key")
+
+	good.Key.Name = "good"
+	good.Key.Path = filepath.Join(dir, "good")
+	good.Key.Secret = masterSec
+	good.Key.Key = userKey
+
+	// The file of a secret that cannot be applied must not be cleaned up.
+	previous := make(manifest)
+	previous.add(bad.Key, []byte("old data"))
+	err = writeFile(bad.Key.Path, []byte("old data"), defaultAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shared.Write(&previous, cfg.Startup.Crypto.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := testGet(200, bad, good)
+	defer ts.Close()
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+
+	cfg.Session.New(cfg)
+
+	rep := new(Report)
+	rep.Login = LoginOK
+
+	if !GetSecretsReport(cfg, rep) {
+		t.Error("Partial failure reported as a failed run")
+	}
+
+	data, err := ioutil.ReadFile(good.Key.Path)
+	if err != nil {
+		t.Fatal("Secret after a failure not written:", err)
+	}
+	if bytes.Compare(data, []byte("secret data")) != 0 {
+		t.Error("Decrypted secret does not match")
+	}
+
+	if _, err = os.Stat(bad.Key.Path); err != nil {
+		t.Error("File of failed secret cleaned up:", err)
+	}
+
+	if rep.Result != ResultPartial {
+		t.Error("Expected a partial result, got", rep.Result)
+	}
+	if len(rep.Files) != 2 {
+		t.Fatal("Expected 2 files, got", rep.Files)
+	}
+	if rep.Files[0].Action != actionFail || rep.Files[0].Error == "" {
+		t.Error("Bad result for failed secret:", rep.Files[0])
+	}
+	if rep.Files[1].Action != actionCreate {
+		t.Error("Bad result for created secret:", rep.Files[1])
+	}
+
+	var buf bytes.Buffer
+	err = rep.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Report
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Login != LoginOK || decoded.Result != ResultPartial || len(decoded.Files) != 2 {
+		t.Error("Bad JSON report:", buf.String())
+	}
+
+	// Cached secrets are applied when the server goes away after we log in
+	ts.Close()
+
+	rep = new(Report)
+	rep.Login = LoginOK
+
+	GetSecretsReport(cfg, rep)
+	if rep.Login != LoginOffline {
+		t.Error("Run using cached secrets not reported as offline")
+	}
+}
+
+func TestReportFinish(t *testing.T) {
+	tests := []struct {
+		rep    Report
+		result string
+	}{
+		{Report{Login: LoginOK}, ResultUnchanged},
+		{Report{Login: LoginOK, Files: []FileReport{{Action: actionUnchanged}, {Action: actionSkip}}}, ResultUnchanged},
+		{Report{Login: LoginOffline, Files: []FileReport{{Action: actionCreate}}}, ResultChanged},
+		{Report{Login: LoginOK, Files: []FileReport{{Action: cleanupRemove}}}, ResultChanged},
+		{Report{Login: LoginOK, Files: []FileReport{{Action: actionCreate}, {Action: actionReject}}}, ResultPartial},
+		{Report{Login: LoginOK, Files: []FileReport{{Action: actionUpdate, Hook: shared.StatusFailed}}}, ResultPartial},
+		{Report{Login: LoginOK, Errors: []string{"manifest"}}, ResultPartial},
+		{Report{Login: LoginFailed}, ResultFatal},
+		{Report{Login: LoginOK, fatal: true}, ResultFatal},
+	}
+
+	for i, test := range tests {
+		if result := test.rep.Finish(); result != test.result {
+			t.Error("Test", i, "expected", test.result, "got", result)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package functions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// errUnknownKeypair is returned when the server sends secrets encrypted for a
+// keypair we do not have.
+var errUnknownKeypair = errors.New("Secrets are encrypted for a keypair this client does not have")
+
+// nextPassPath is where a new password is kept while the server is told about
+// it.  If it is still there afterwards, we do not know if the server accepted
+// it.
+func nextPassPath(cfg *shared.Config) string {
+	return cfg.Startup.Crypto.Password + ".next"
+}
+
+// nextKeyPath is where the keypair we have rotated to is kept, until the
+// server starts sending secrets encrypted for it.
+func nextKeyPath(cfg *shared.Config) string {
+	return cfg.Startup.Crypto.KeyPair + ".next"
+}
+
+// Rotate replaces our password and keypair.  The new password is used from
+// now on, but our secrets remain encrypted for the old keypair until an admin
+// re-encrypts them with 'client rekey', as the server cannot do so itself.
+// Until then, both keypairs are kept.
+// We must already be logged in.
+func Rotate(cfg *shared.Config) (ok bool) {
+	nextPass := nextPassPath(cfg)
+
+	// An earlier rotation that lost the server's reply leaves its new
+	// credentials behind.  If the server accepted them, that rotation is
+	// finished, otherwise they are discarded.
+	_, err := os.Stat(nextPass)
+	if err == nil {
+		accepted, err := promoteNext(cfg)
+		switch {
+		case err != nil:
+			cfg.Log(log.ERROR, "Unable to tell if the server accepted", nextPass+":", err)
+			return
+		case accepted:
+			cfg.Log(log.INFO, "Completed an earlier rotation, new key fingerprint", nextFingerprint(cfg))
+			return true
+		}
+
+		cfg.Log(log.WARN, "Discarding credentials from an earlier rotation the server did not accept")
+		err = discardNext(cfg)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			return
+		}
+	}
+
+	password := make(crypto.Binary, 32)
+	_, err = io.ReadFull(rand.Reader, password)
+	if err != nil {
+		cfg.Log(log.ERROR, "Error generating password:", err)
+		return
+	}
+
+	keypair := new(crypto.Key)
+	err = keypair.Generate()
+	if err != nil {
+		cfg.Log(log.ERROR, "Error generating keypair:", err)
+		return
+	}
+	defer keypair.Zero()
+
+	// Both are saved before the server is told about them, so that we cannot
+	// end up with credentials the server has accepted but we have lost.
+	err = writeEncoded(keypair, nextKeyPath(cfg))
+	if err == nil {
+		err = writeEncoded(&password, nextPass)
+	}
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		os.Remove(nextKeyPath(cfg))
+		return
+	}
+
+	var msg shared.Message
+	msg.User.Password = password
+	msg.User.Key = keypair.Pub[:]
+
+	_, err = cfg.Session.Post("/client/rotate", msg)
+	switch {
+	case err == nil:
+		err = usePassword(cfg, password)
+		if err != nil {
+			cfg.Log(log.ERROR, "Unable to replace password file, this client cannot log in until",
+				nextPass, "is moved to", cfg.Startup.Crypto.Password, ":", err)
+			return
+		}
+
+	case shared.IsConnError(err) || shared.IsRejected(err):
+		// The request never reached the server, or it refused the change.
+		cfg.Log(log.ERROR, err)
+		discardNext(cfg)
+		return
+
+	default:
+		// The server may have made the change before the reply was lost.
+		cfg.Log(log.ERROR, err)
+		accepted, err := promoteNext(cfg)
+		switch {
+		case err != nil:
+			cfg.Log(log.ERROR, "Unable to tell if the server accepted the new credentials, they are kept in",
+				nextPass, "and will be tried the next time the current password is refused")
+			return
+		case !accepted:
+			discardNext(cfg)
+			return
+		}
+	}
+
+	cfg.Log(log.INFO, "Credentials rotated, new key fingerprint", crypto.Fingerprint(keypair.Pub[:]))
+	cfg.Log(log.INFO, "Secrets will be decrypted with the old keypair until they are rekeyed with",
+		"'client rekey --name", cfg.Startup.NodeName+"'")
+
+	return true
+}
+
+// Login logs in with our current password.  If the server refuses it and an
+// earlier rotation left a new password behind, the server accepted that
+// rotation, so the new password is tried and kept if it works.
+func Login(cfg *shared.Config) error {
+	err := cfg.Session.Login(cfg)
+	if !shared.IsRejected(err) {
+		return err
+	}
+	if _, statErr := os.Stat(nextPassPath(cfg)); statErr != nil {
+		return err
+	}
+
+	accepted, nextErr := promoteNext(cfg)
+	if nextErr != nil || !accepted {
+		return err
+	}
+	cfg.Log(log.INFO, "Completed an earlier rotation, new key fingerprint", nextFingerprint(cfg))
+
+	return cfg.Session.Login(cfg)
+}
+
+// promoteNext logs in with the password left by an earlier rotation, on a
+// session of its own.  If the server accepts it, it replaces our current
+// password.  accepted is false if the server refused it.
+func promoteNext(cfg *shared.Config) (accepted bool, err error) {
+	var password crypto.Binary
+	err = shared.Read(&password, nextPassPath(cfg))
+	if err != nil {
+		return
+	}
+
+	var session shared.Session
+	err = session.New(cfg)
+	if err != nil {
+		return
+	}
+
+	current := cfg.Runtime.Password
+	cfg.Runtime.Password = password
+	err = session.Login(cfg)
+	cfg.Runtime.Password = current
+
+	if shared.IsRejected(err) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	session.Logout(cfg)
+
+	return true, usePassword(cfg, password)
+}
+
+// usePassword moves the password saved by a rotation into place.
+func usePassword(cfg *shared.Config, password crypto.Binary) error {
+	err := os.Rename(nextPassPath(cfg), cfg.Startup.Crypto.Password)
+	if err != nil {
+		return err
+	}
+	cfg.Runtime.Password = password
+	return nil
+}
+
+// discardNext removes the credentials saved by a rotation the server did not
+// accept.
+func discardNext(cfg *shared.Config) error {
+	err := os.Remove(nextPassPath(cfg))
+	if err == nil || os.IsNotExist(err) {
+		err = os.Remove(nextKeyPath(cfg))
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// nextFingerprint returns the fingerprint of the keypair saved by a rotation.
+func nextFingerprint(cfg *shared.Config) string {
+	next := new(crypto.Key)
+	err := shared.Read(next, nextKeyPath(cfg))
+	if err != nil {
+		return "unknown"
+	}
+	defer next.Zero()
+	return crypto.Fingerprint(next.Pub[:])
+}
+
+// writeEncoded atomically replaces path with the encoded form of d.
+func writeEncoded(d shared.FileData, path string) error {
+	data, err := d.Encode()
+	if err != nil {
+		return err
+	}
+	defer crypto.Zero(data)
+
+	return writeFile(path, data, defaultAttrs)
+}
+
+// keypairFor returns the keypair that can decrypt secrets encrypted for pub.
+// If that is the keypair we rotated to, it replaces our current keypair, as
+// an admin has rekeyed our secrets.  In dry-run and exec mode nothing is
+// replaced, and the caller must zero the returned keypair if it is not our
+// current one.
+// An empty pub means our current keypair.
+func keypairFor(cfg *shared.Config, pub []byte) (*crypto.Key, error) {
+	current := cfg.Runtime.Keypair
+	if len(pub) == 0 || (current.Pub != nil && bytes.Equal(pub, current.Pub[:])) {
+		return current, nil
+	}
+
+	next := new(crypto.Key)
+	err := shared.Read(next, nextKeyPath(cfg))
+
+	if os.IsNotExist(err) {
+		// Another process may have already switched to the new keypair.
+		err = shared.Read(next, cfg.Startup.Crypto.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pub, next.Pub[:]) {
+			next.Zero()
+			return nil, errUnknownKeypair
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		if !bytes.Equal(pub, next.Pub[:]) {
+			next.Zero()
+			return nil, errUnknownKeypair
+		}
+
+		if cfg.Runtime.DryRun || cfg.Runtime.Exec {
+			return next, nil
+		}
+
+		err = os.Rename(nextKeyPath(cfg), cfg.Startup.Crypto.KeyPair)
+		if err != nil {
+			next.Zero()
+			return nil, err
+		}
+		cfg.Log(log.INFO, "Secrets have been rekeyed, now using key fingerprint",
+			crypto.Fingerprint(next.Pub[:]))
+	}
+
+	current.Zero()
+	cfg.Runtime.Keypair = next
+
+	return next, nil
+}
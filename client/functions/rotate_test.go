@@ -0,0 +1,467 @@
+package functions
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/shared"
+)
+
+func TestRotate(t *testing.T) {
+	cfg.NewClient()
+	cfg.Runtime.CA = nil
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.KeyPair = filepath.Join(dir, "key")
+	cfg.Startup.Crypto.Password = filepath.Join(dir, "password")
+	defer func() {
+		cfg.Startup.Crypto.KeyPair = ""
+		cfg.Startup.Crypto.Password = ""
+	}()
+
+	var posted shared.Message
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := shared.ReadResp(r.Body)
+		if err != nil || len(req) != 1 || r.URL.Path != "/client/rotate" {
+			w.WriteHeader(400)
+			return
+		}
+		posted = req[0]
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+
+	cfg.Session.New(cfg)
+
+	// Left behind by an earlier rotation that could not reach the server
+	stale := new(crypto.Key)
+	stale.Generate()
+	err = shared.Write(stale, nextKeyPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalePass := crypto.Binary("stale")
+	err = shared.Write(&stalePass, nextPassPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !Rotate(cfg) {
+		t.Fatal("Rotate failed")
+	}
+
+	var password crypto.Binary
+	err = shared.Read(&password, cfg.Startup.Crypto.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(password) != 32 || !bytes.Equal(password, posted.User.Password) {
+		t.Error("Password file does not match the password sent")
+	}
+
+	_, err = os.Stat(cfg.Startup.Crypto.Password + ".next")
+	if !os.IsNotExist(err) {
+		t.Error("Temporary password file left behind")
+	}
+
+	next := new(crypto.Key)
+	err = shared.Read(next, nextKeyPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(next.Pub[:], posted.User.Key) {
+		t.Error("Saved keypair does not match the public key sent")
+	}
+}
+
+func TestKeypairFor(t *testing.T) {
+	cfg.Runtime.Keypair = new(crypto.Key)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.KeyPair = filepath.Join(dir, "key")
+	defer func() {
+		cfg.Startup.Crypto.KeyPair = ""
+	}()
+
+	err = cfg.Runtime.Keypair.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shared.Write(cfg.Runtime.Keypair, cfg.Startup.Crypto.KeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := new(crypto.Key)
+	next.Generate()
+	err = shared.Write(next, nextKeyPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextPub := append([]byte{}, next.Pub[:]...)
+
+	current := cfg.Runtime.Keypair
+
+	key, err := keypairFor(cfg, nil)
+	if err != nil || key != current {
+		t.Error("Current keypair not used for secrets without a public key")
+	}
+
+	key, err = keypairFor(cfg, current.Pub[:])
+	if err != nil || key != current {
+		t.Error("Current keypair not used for its own public key")
+	}
+
+	_, err = keypairFor(cfg, make([]byte, 32))
+	if err != errUnknownKeypair {
+		t.Error("Expected unknown keypair, got", err)
+	}
+
+	key, err = keypairFor(cfg, nextPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Pub[:], nextPub) || cfg.Runtime.Keypair != key {
+		t.Error("Rotated keypair not used")
+	}
+
+	_, err = os.Stat(nextKeyPath(cfg))
+	if !os.IsNotExist(err) {
+		t.Error("Rotated keypair not moved into place")
+	}
+
+	saved := new(crypto.Key)
+	err = shared.Read(saved, cfg.Startup.Crypto.KeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved.Pub[:], nextPub) {
+		t.Error("Keypair file not replaced")
+	}
+}
+
+// Once an admin has rekeyed our secrets, a dry run must not switch keypairs,
+// so that the next real run does.
+func TestRekeyDryRun(t *testing.T) {
+	cfg.NewClient()
+	cfg.Runtime.CA = nil
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	dryRunOutput = &out
+	cfg.Startup.Crypto.KeyPair = filepath.Join(dir, "key")
+	cfg.Startup.Crypto.Manifest = filepath.Join(dir, "manifest.json")
+	cfg.Startup.Crypto.Cache = filepath.Join(dir, "cache.json")
+	defer func() {
+		dryRunOutput = os.Stdout
+		cfg.Runtime.DryRun = false
+		cfg.Startup.Crypto.KeyPair = ""
+		cfg.Startup.Crypto.Manifest = ""
+		cfg.Startup.Crypto.Cache = ""
+	}()
+
+	err = cfg.Runtime.Keypair.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shared.Write(cfg.Runtime.Keypair, cfg.Startup.Crypto.KeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := cfg.Runtime.Keypair
+
+	next := new(crypto.Key)
+	next.Generate()
+	err = shared.Write(next, nextKeyPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	super := new(crypto.Key)
+	super.Generate()
+	master := new(crypto.Key)
+	master.Generate()
+
+	var resp shared.Message
+	resp.Key.Secret, err = crypto.Encrypt([]byte("secret data"), super, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Key.Key, err = crypto.Encrypt(master.Priv[:], super, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Key.Name = "rekeyed"
+	resp.Key.Path = filepath.Join(dir, "secret")
+	resp.User.Key = next.Pub[:]
+
+	ts := testGet(200, resp)
+	defer ts.Close()
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+
+	cfg.Session.New(cfg)
+
+	cfg.Runtime.DryRun = true
+
+	if !GetSecrets(cfg) {
+		t.Fatal("Dry run failed")
+	}
+	if cfg.Runtime.Keypair != current {
+		t.Error("Keypair replaced in dry-run mode")
+	}
+	if _, err = os.Stat(nextKeyPath(cfg)); err != nil {
+		t.Error("Rotated keypair moved in dry-run mode:", err)
+	}
+	if _, err = os.Stat(resp.Key.Path); !os.IsNotExist(err) {
+		t.Error("Secret written in dry-run mode")
+	}
+
+	cfg.Runtime.DryRun = false
+
+	if !GetSecrets(cfg) {
+		t.Fatal("Failed to get secrets after a dry run")
+	}
+	if !bytes.Equal(cfg.Runtime.Keypair.Pub[:], next.Pub[:]) {
+		t.Error("Rotated keypair not used after a dry run")
+	}
+	if _, err = os.Stat(nextKeyPath(cfg)); !os.IsNotExist(err) {
+		t.Error("Rotated keypair not moved into place after a dry run")
+	}
+
+	saved := new(crypto.Key)
+	err = shared.Read(saved, cfg.Startup.Crypto.KeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved.Pub[:], next.Pub[:]) {
+		t.Error("Keypair file not replaced after a dry run")
+	}
+
+	data, err := ioutil.ReadFile(resp.Key.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret data" {
+		t.Error("Decrypted secret does not match")
+	}
+}
+
+// passwordServer accepts logins with a single password, which /client/rotate
+// replaces.  If drop is set, the connection is closed once the new password
+// has been saved, so that the client never sees the reply.
+type passwordServer struct {
+	mu       sync.Mutex
+	password []byte
+	drop     bool
+	rotated  shared.Message
+}
+
+func (p *passwordServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/login":
+		req, err := shared.ReadResp(r.Body)
+		if err != nil || len(req) != 1 || !bytes.Equal(req[0].Auth.Password, p.password) {
+			w.WriteHeader(401)
+			return
+		}
+		key := crypto.Binary("session key")
+		enc, _ := key.Encode()
+		w.Header().Set(shared.HdrSession, "1")
+		w.Header().Set(shared.HdrKey, string(enc))
+		w.WriteHeader(200)
+
+	case "/logout":
+		w.WriteHeader(200)
+
+	case "/client/rotate":
+		req, err := shared.ReadResp(r.Body)
+		if err != nil || len(req) != 1 {
+			w.WriteHeader(400)
+			return
+		}
+		p.rotated = req[0]
+		p.password = req[0].User.Password
+		if !p.drop {
+			w.WriteHeader(204)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// rotateSetup points the client at a temporary directory holding password, and
+// at srv.
+func rotateSetup(t *testing.T, password crypto.Binary, srv http.Handler) (cleanup func()) {
+	cfg.NewClient()
+	cfg.Runtime.CA = nil
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Startup.Crypto.KeyPair = filepath.Join(dir, "key")
+	cfg.Startup.Crypto.Password = filepath.Join(dir, "password")
+	cfg.Runtime.Password = password
+	err = shared.Write(&password, cfg.Startup.Crypto.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewTLSServer(srv)
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+	cfg.Session = shared.Session{}
+	cfg.Session.New(cfg)
+
+	return func() {
+		cfg.Session = shared.Session{}
+		ts.Close()
+		os.RemoveAll(dir)
+		cfg.Startup.Crypto.KeyPair = ""
+		cfg.Startup.Crypto.Password = ""
+	}
+}
+
+func TestRotateConnectionDropped(t *testing.T) {
+	srv := &passwordServer{password: []byte("old password"), drop: true}
+	defer rotateSetup(t, crypto.Binary("old password"), srv)()
+
+	// The server saved the new password, so it must be kept.
+	if !Rotate(cfg) {
+		t.Fatal("Rotate failed after the server accepted it")
+	}
+
+	var password crypto.Binary
+	err := shared.Read(&password, cfg.Startup.Crypto.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(password, srv.password) || !bytes.Equal(cfg.Runtime.Password, srv.password) {
+		t.Error("New password not kept after the connection dropped")
+	}
+
+	next := new(crypto.Key)
+	err = shared.Read(next, nextKeyPath(cfg))
+	if err != nil {
+		t.Fatal("New keypair not kept after the connection dropped:", err)
+	}
+	if !bytes.Equal(next.Pub[:], srv.rotated.User.Key) {
+		t.Error("Saved keypair does not match the public key sent")
+	}
+
+	err = Login(cfg)
+	if err != nil {
+		t.Error("Unable to log in after rotating:", err)
+	}
+}
+
+func TestRotateRejected(t *testing.T) {
+	refuse := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	})
+	defer rotateSetup(t, crypto.Binary("old password"), refuse)()
+
+	if Rotate(cfg) {
+		t.Fatal("Rejected rotation reported as successful")
+	}
+
+	for _, path := range []string{nextPassPath(cfg), nextKeyPath(cfg)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error(path, "kept after the server refused it")
+		}
+	}
+
+	var password crypto.Binary
+	err := shared.Read(&password, cfg.Startup.Crypto.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "old password" {
+		t.Error("Password replaced after the server refused it")
+	}
+}
+
+// A rotation whose reply was lost, and that the server accepted, is completed
+// at the next login.
+func TestLoginAcceptedRotation(t *testing.T) {
+	srv := &passwordServer{password: []byte("new password")}
+	defer rotateSetup(t, crypto.Binary("old password"), srv)()
+
+	newPass := crypto.Binary("new password")
+	err := shared.Write(&newPass, nextPassPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := new(crypto.Key)
+	next.Generate()
+	err = shared.Write(next, nextKeyPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Login(cfg)
+	if err != nil {
+		t.Fatal("Login failed:", err)
+	}
+
+	var password crypto.Binary
+	err = shared.Read(&password, cfg.Startup.Crypto.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "new password" || string(cfg.Runtime.Password) != "new password" {
+		t.Error("Accepted password not made current")
+	}
+	if _, err = os.Stat(nextPassPath(cfg)); !os.IsNotExist(err) {
+		t.Error("Accepted password left in place")
+	}
+	if _, err = os.Stat(nextKeyPath(cfg)); err != nil {
+		t.Error("Keypair of the accepted rotation removed:", err)
+	}
+
+	// Rotating again discards nothing the server has accepted.
+	srv.password = []byte("new password")
+	err = shared.Write(&newPass, nextPassPath(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Rotate(cfg) {
+		t.Fatal("Rotate failed")
+	}
+	if srv.rotated.User.Password != nil {
+		t.Error("Rotated again instead of completing the earlier rotation")
+	}
+}
@@ -0,0 +1,269 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// Sink renders the secrets assigned to a path into the contents of the file
+// written there.  Each assignment selects a sink by name, and every secret
+// assigned to the same path is given to the sink together, so sinks can
+// aggregate several secrets into one file.
+// Secrets are sorted by name.  Sinks must not keep references to their data,
+// which is zeroed once the file has been written.
+type Sink interface {
+	Render(secrets []SinkSecret) ([]byte, error)
+}
+
+// SinkSecret is a decrypted secret given to a sink.
+type SinkSecret struct {
+	Key  shared.Key
+	Data []byte
+}
+
+// SinkFunc adapts an ordinary function to the Sink interface.
+type SinkFunc func(secrets []SinkSecret) ([]byte, error)
+
+// Render calls f.
+func (f SinkFunc) Render(secrets []SinkSecret) ([]byte, error) {
+	return f(secrets)
+}
+
+// The built-in sinks.
+const (
+	SinkRaw    = "raw"    // The secret as it is, one secret per file.  The default
+	SinkDotenv = "dotenv" // NAME=value lines, named as in exec mode
+	SinkJSON   = "json"   // A JSON object of secret names to values
+	SinkPEM    = "pem"    // Secrets concatenated in name order
+)
+
+var sinkLock sync.RWMutex
+
+var sinks = map[string]Sink{
+	SinkRaw:    SinkFunc(rawSink),
+	SinkDotenv: SinkFunc(dotenvSink),
+	SinkJSON:   SinkFunc(jsonSink),
+	SinkPEM:    SinkFunc(pemSink),
+}
+
+// RegisterSink makes a sink available to assignments under name.  The names
+// of built-in sinks cannot be reused.  Names may only contain lower case
+// letters, digits, underscores and dashes, as the server refuses others.
+func RegisterSink(name string, sink Sink) error {
+	if !validSinkName.MatchString(name) {
+		return fmt.Errorf("Invalid sink name %q", name)
+	}
+
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	if _, exists := sinks[name]; exists {
+		return fmt.Errorf("Sink %s is already registered", name)
+	}
+	sinks[name] = sink
+	return nil
+}
+
+var validSinkName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// sinkFor returns the sink secrets assigned to path are written with.  The
+// client config may override the sink chosen by the assignment.
+func sinkFor(cfg *shared.Config, path string, key shared.Key) (name string, sink Sink, err error) {
+	name = cfg.Startup.Client.Sinks[filepath.Clean(path)]
+	if name == "" {
+		name = key.Sink
+	}
+	if name == "" {
+		name = SinkRaw
+	}
+
+	sinkLock.RLock()
+	sink, ok := sinks[name]
+	sinkLock.RUnlock()
+
+	if !ok {
+		return name, nil, fmt.Errorf("Unknown sink %s", name)
+	}
+	return
+}
+
+func rawSink(secrets []SinkSecret) ([]byte, error) {
+	if len(secrets) != 1 {
+		return nil, fmt.Errorf("%d secrets assigned to the same path, only one can be written as raw",
+			len(secrets))
+	}
+	return append([]byte{}, secrets[0].Data...), nil
+}
+
+// unquoted matches values that can be written in a dotenv file as they are.
+var unquoted = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+
+func dotenvSink(secrets []SinkSecret) ([]byte, error) {
+	var buf bytes.Buffer
+	names := make(map[string]string)
+
+	for _, s := range secrets {
+		name := envName(s.Key)
+		if prev, exists := names[name]; exists {
+			return nil, fmt.Errorf("Secrets %s and %s are both named %s", prev, s.Key.Name, name)
+		}
+		names[name] = s.Key.Name
+
+		buf.WriteString(name + "=")
+		if unquoted.Match(s.Data) {
+			buf.Write(s.Data)
+		} else {
+			buf.WriteString(`"` + dotenvEscaper.Replace(string(s.Data)) + `"`)
+		}
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+func jsonSink(secrets []SinkSecret) ([]byte, error) {
+	values := make(map[string]string)
+	for _, s := range secrets {
+		values[s.Key.Name] = string(s.Data)
+	}
+
+	data, err := json.MarshalIndent(values, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func pemSink(secrets []SinkSecret) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, s := range secrets {
+		buf.Write(s.Data)
+		if len(s.Data) > 0 && s.Data[len(s.Data)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// output is a file that one or more secrets are written to.
+type output struct {
+	path    string
+	secrets []SinkSecret
+}
+
+// outputs collects secrets by the path they are written to, in the order the
+// paths were first seen.
+type outputs struct {
+	list  []*output
+	paths map[string]*output
+}
+
+// add assigns a secret to the file at key.Path.  A secret assigned both
+// directly and via a group is only added once.
+func (o *outputs) add(key shared.Key, data []byte) {
+	if o.paths == nil {
+		o.paths = make(map[string]*output)
+	}
+
+	out, exists := o.paths[key.Path]
+	if !exists {
+		out = &output{path: key.Path}
+		o.paths[key.Path] = out
+		o.list = append(o.list, out)
+	}
+
+	for _, s := range out.secrets {
+		if s.Key.Name == key.Name {
+			return
+		}
+	}
+	out.secrets = append(out.secrets, SinkSecret{Key: key, Data: data})
+}
+
+// writeOutput renders the secrets assigned to a file with their sink, and
+// writes the result.  The outcome is recorded against every secret in the
+// file.  Ownership and permissions are taken from the first secret by name.
+func writeOutput(cfg *shared.Config, out *output, current manifest, changed *hooks,
+	status *statusReport, rep *Report) (ok bool) {
+
+	sortSecrets(out.secrets)
+
+	data, err := render(cfg, out)
+	if err != nil {
+		cfg.Log(log.ERROR, "Unable to write", out.path+":", err)
+		for _, s := range out.secrets {
+			status.add(s.Key, err)
+			rep.file(FileReport{Secret: s.Key.Name, Path: out.path}, err)
+		}
+		return false
+	}
+	defer crypto.Zero(data)
+
+	action, err := updateFile(cfg, out.secrets[0].Key, data, changed)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+	}
+
+	var names []string
+	for i, s := range out.secrets {
+		names = append(names, s.Key.Name)
+
+		if err != nil {
+			status.add(s.Key, errUpdateFailed)
+		} else {
+			status.add(s.Key, nil)
+		}
+		rep.file(FileReport{Secret: s.Key.Name, Path: out.path, Action: action}, err)
+
+		// updateFile has already queued the hooks of the first secret.
+		if i > 0 && (action == actionCreate || action == actionUpdate) {
+			changed.add(cfg, s.Key)
+		}
+	}
+
+	if err != nil {
+		return false
+	}
+
+	current[out.path] = manifestEntry{Name: strings.Join(names, ","), Hash: fileHash(data)}
+	return true
+}
+
+// render converts the secrets assigned to a file into its contents.  They
+// must all use the same sink.
+func render(cfg *shared.Config, out *output) (data []byte, err error) {
+	var name string
+	var sink Sink
+
+	for _, s := range out.secrets {
+		n, sk, err := sinkFor(cfg, out.path, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" && n != name {
+			return nil, fmt.Errorf("Secrets assigned to the same path use different sinks, %s and %s", name, n)
+		}
+		name, sink = n, sk
+	}
+
+	return sink.Render(out.secrets)
+}
+
+// sortSecrets sorts the secrets given to a sink by name.
+func sortSecrets(secrets []SinkSecret) {
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Key.Name < secrets[j].Key.Name
+	})
+}
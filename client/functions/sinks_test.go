@@ -0,0 +1,177 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func sinkSecret(name, data string) SinkSecret {
+	return SinkSecret{Key: shared.Key{Name: name}, Data: []byte(data)}
+}
+
+func TestSinks(t *testing.T) {
+	tests := []struct {
+		sink     string
+		secrets  []SinkSecret
+		expected string
+		err      bool
+	}{
+		{SinkRaw, []SinkSecret{sinkSecret("a", "data")}, "data", false},
+		{SinkRaw, []SinkSecret{sinkSecret("a", "1"), sinkSecret("b", "2")}, "", true},
+		{SinkDotenv, []SinkSecret{sinkSecret("db-user", "app"), sinkSecret("db-pass", `p"w $x`)},
+			"DB_USER=app\nDB_PASS=\"p\\\"w \\$x\"\n", false},
+		{SinkDotenv, []SinkSecret{sinkSecret("db-pass", "1"), sinkSecret("db.pass", "2")}, "", true},
+		{SinkPEM, []SinkSecret{sinkSecret("cert", "CERT\n"), sinkSecret("key", "KEY")}, "CERT\nKEY\n", false},
+	}
+
+	for _, test := range tests {
+		data, err := sinks[test.sink].Render(test.secrets)
+		if test.err {
+			if err == nil {
+				t.Error("Expected error from", test.sink, "sink")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(data) != test.expected {
+			t.Errorf("%s sink: expected %q got %q", test.sink, test.expected, data)
+		}
+	}
+
+	data, err := jsonSink([]SinkSecret{sinkSecret("a", "1"), sinkSecret("b", "two\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]string
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["a"] != "1" || values["b"] != "two\n" {
+		t.Error("Bad json sink output", values)
+	}
+}
+
+func TestRegisterSink(t *testing.T) {
+	upper := SinkFunc(func(secrets []SinkSecret) ([]byte, error) {
+		return bytes.ToUpper(secrets[0].Data), nil
+	})
+
+	if RegisterSink(SinkRaw, upper) == nil {
+		t.Error("Able to replace a built-in sink")
+	}
+	if RegisterSink("Upper Case", upper) == nil {
+		t.Error("Able to register an invalid sink name")
+	}
+
+	err := RegisterSink("test-upper", upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sinkLock.Lock()
+		delete(sinks, "test-upper")
+		sinkLock.Unlock()
+	}()
+
+	out := &output{path: "/test", secrets: []SinkSecret{
+		{Key: shared.Key{Name: "a", Sink: "test-upper"}, Data: []byte("data")},
+	}}
+	data, err := render(cfg, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "DATA" {
+		t.Error("Registered sink not used, got", string(data))
+	}
+
+	// The client config overrides the assignment
+	cfg.Startup.Client.Sinks = map[string]string{"/test": SinkRaw}
+	defer func() {
+		cfg.Startup.Client.Sinks = nil
+	}()
+
+	data, err = render(cfg, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Error("Sink not overridden by config, got", string(data))
+	}
+}
+
+func TestRender(t *testing.T) {
+	out := &output{path: "/test", secrets: []SinkSecret{
+		{Key: shared.Key{Name: "a", Sink: SinkDotenv}, Data: []byte("1")},
+		{Key: shared.Key{Name: "b", Sink: SinkJSON}, Data: []byte("2")},
+	}}
+	if _, err := render(cfg, out); err == nil {
+		t.Error("Rendered secrets with different sinks")
+	}
+
+	out.secrets[1].Key.Sink = "no-such-sink"
+	if _, err := render(cfg, out); err == nil {
+		t.Error("Rendered secret with an unknown sink")
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.env")
+
+	var files outputs
+	files.add(shared.Key{Name: "db-user", Path: path, Sink: SinkDotenv}, []byte("app"))
+	files.add(shared.Key{Name: "db-pass", Path: path, Sink: SinkDotenv, Command: "true"}, []byte("pw"))
+	// Assigned both directly and via a group
+	files.add(shared.Key{Name: "db-user", Path: path, Sink: SinkDotenv}, []byte("app"))
+
+	if len(files.list) != 1 || len(files.list[0].secrets) != 2 {
+		t.Fatal("Secrets not grouped by path")
+	}
+
+	current := make(manifest)
+	var changed hooks
+	var status statusReport
+	rep := new(Report)
+
+	if !writeOutput(cfg, files.list[0], current, &changed, &status, rep) {
+		t.Fatal("Failed to write output")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "DB_PASS=pw\nDB_USER=app\n" {
+		t.Errorf("Bad file contents %q", data)
+	}
+
+	if current[path].Name != "db-pass,db-user" {
+		t.Error("Bad manifest entry", current[path])
+	}
+	if len(status) != 2 || len(rep.Files) != 2 {
+		t.Error("Outcome not recorded for every secret")
+	}
+	for _, f := range rep.Files {
+		if f.Action != actionCreate {
+			t.Error("Expected", actionCreate, "got", f.Action)
+		}
+	}
+	if len(changed.commands) != 1 {
+		t.Error("Hook not queued for the second secret")
+	}
+}
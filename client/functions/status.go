@@ -0,0 +1,50 @@
+package functions
+
+import (
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// statusReport collects the outcome of applying each secret during a sync.
+// It is sent to the server so that admins can tell which clients have
+// applied the current version of a secret.
+type statusReport []shared.SecretStatus
+
+// add records the outcome of applying key.  A nil err means it was applied.
+func (s *statusReport) add(key shared.Key, err error) {
+	status := shared.SecretStatus{
+		Name:   key.Name,
+		Path:   key.Path,
+		Hash:   shared.SecretHash(key.Secret),
+		Result: shared.StatusOK,
+	}
+	if err != nil {
+		status.Result = shared.StatusFailed
+		status.Error = err.Error()
+	}
+	*s = append(*s, status)
+}
+
+// send fills in the result of any hooks that were run and posts the report
+// to the server.  Nothing is sent in a dry run, as nothing was applied, or
+// when we are using cached secrets, as the server cannot be reached.
+// Failing to send the report does not fail the sync.
+func (s statusReport) send(cfg *shared.Config, h *hooks) {
+	if cfg.Runtime.DryRun || cfg.Runtime.Offline || len(s) == 0 {
+		return
+	}
+
+	for i := range s {
+		if s[i].Path != "" {
+			s[i].Hook = h.result(s[i].Path)
+		}
+	}
+
+	var msg shared.Message
+	msg.Status = s
+
+	_, err := cfg.Session.Post("/client/status", msg)
+	if err != nil {
+		cfg.Log(log.WARN, "Unable to report secret status:", err)
+	}
+}
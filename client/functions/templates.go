@@ -0,0 +1,120 @@
+package functions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"text/template"
+
+	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/shared"
+)
+
+// renderTemplates renders each configured template with the secrets we have
+// been sent, and writes the result to its destination, recording what was
+// done in rep.
+// The rendered output is compared with the existing destination file, so a
+// destination is only rewritten (and its hooks run) when a secret it uses has
+// changed, or the template itself has been edited.
+// A template that fails to render is skipped, leaving the previous output in
+// place, and does not prevent other templates from being rendered.
+func renderTemplates(cfg *shared.Config, secrets map[string][]byte, changed *hooks, rep *Report) (ok bool) {
+	ok = true
+
+	for _, t := range cfg.Startup.Client.Templates {
+		result := FileReport{Template: t.Source, Path: t.Dest}
+
+		key, err := templateKey(t)
+		if err != nil {
+			cfg.Log(log.ERROR, "Invalid template", t.Source, err)
+			rep.file(result, err)
+			ok = false
+			continue
+		}
+
+		out, err := renderTemplate(t.Source, secrets)
+		if err != nil {
+			cfg.Log(log.ERROR, "Unable to render template", t.Source, err)
+			rep.file(result, err)
+			ok = false
+			continue
+		}
+
+		result.Action, err = updateFile(cfg, key, out, changed)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			ok = false
+		}
+		rep.file(result, err)
+		crypto.Zero(out)
+	}
+
+	return
+}
+
+// renderTemplate executes the template at path.  Secrets are referenced by
+// name with {{ secret "name" }}, and referencing a secret that has not been
+// assigned to this client is an error.
+func renderTemplate(path string, secrets map[string][]byte) (out []byte, err error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	funcs := template.FuncMap{
+		"secret": func(name string) (string, error) {
+			s, ok := secrets[name]
+			if !ok {
+				return "", fmt.Errorf("secret %s is not assigned to this client", name)
+			}
+			return string(s), nil
+		},
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(funcs).Parse(string(src))
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, nil)
+	if err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+// templateKey converts a template config entry into the key used to write
+// its destination file.
+func templateKey(t shared.Template) (key shared.Key, err error) {
+	if t.Source == "" || t.Dest == "" {
+		return key, errors.New("Source and Dest must both be set")
+	}
+	if !filepath.IsAbs(t.Dest) {
+		return key, errors.New("Dest must be an absolute path")
+	}
+
+	key.Path = filepath.Clean(t.Dest)
+	key.Owner = t.Owner
+	key.Group = t.Group
+	key.Command = t.Command
+
+	if t.Mode != "" {
+		var mode uint64
+		mode, err = strconv.ParseUint(t.Mode, 8, 32)
+		if err != nil {
+			return key, fmt.Errorf("Invalid mode %s", t.Mode)
+		}
+		if mode > 0777 {
+			return key, errors.New("Mode may only contain permission bits")
+		}
+		key.Mode = uint32(mode)
+	}
+
+	return
+}
@@ -0,0 +1,106 @@
+package functions
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "database.yml.tmpl")
+	err = ioutil.WriteFile(path, []byte(`password: {{ secret "db" }}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := map[string][]byte{"db": []byte("hunter2")}
+
+	out, err := renderTemplate(path, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(out, []byte("password: hunter2")) != 0 {
+		t.Error("Bad output:", string(out))
+	}
+
+	_, err = renderTemplate(path, map[string][]byte{})
+	if err == nil {
+		t.Error("Rendered template with a missing secret")
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tmpl shared.Template
+	tmpl.Source = filepath.Join(dir, "app.conf.tmpl")
+	tmpl.Dest = filepath.Join(dir, "app.conf")
+	tmpl.Mode = "0640"
+	tmpl.Command = "reload app"
+
+	err = ioutil.WriteFile(tmpl.Source, []byte(`key={{ secret "app" }}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Startup.Client.Templates = []shared.Template{tmpl}
+	defer func() { cfg.Startup.Client.Templates = nil }()
+
+	var h hooks
+	if !renderTemplates(cfg, map[string][]byte{"app": []byte("one")}, &h, new(Report)) {
+		t.Fatal("Failed to render templates")
+	}
+	if len(h.commands) != 1 {
+		t.Error("Hook not queued for new file")
+	}
+
+	fi, err := os.Stat(tmpl.Dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Error("Bad file mode:", fi.Mode().Perm())
+	}
+
+	h = hooks{}
+	if !renderTemplates(cfg, map[string][]byte{"app": []byte("one")}, &h, new(Report)) {
+		t.Fatal("Failed to render templates")
+	}
+	if len(h.commands) != 0 {
+		t.Error("Hook queued for unchanged file")
+	}
+
+	h = hooks{}
+	if !renderTemplates(cfg, map[string][]byte{"app": []byte("two")}, &h, new(Report)) {
+		t.Fatal("Failed to render templates")
+	}
+	if len(h.commands) != 1 {
+		t.Error("Hook not queued for changed file")
+	}
+
+	data, err := ioutil.ReadFile(tmpl.Dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(data, []byte("key=two")) != 0 {
+		t.Error("Bad output:", string(data))
+	}
+
+	if renderTemplates(cfg, map[string][]byte{}, &h, new(Report)) {
+		t.Error("Template with a missing secret rendered successfully")
+	}
+}
@@ -0,0 +1,35 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jfindley/skds/shared"
+)
+
+var errNoETag = errors.New("No cached secrets to watch for changes to")
+
+// Watch waits for the server to tell us our secrets have changed since they
+// were cached, returning true if they have, or false if the server gave up
+// waiting first.  The server is asked to give up after timeout.  If ctx is
+// cancelled, Watch returns at once, and the session must be logged in again
+// before it is used.
+func Watch(ctx context.Context, cfg *shared.Config, timeout time.Duration) (changed bool, err error) {
+	cache, err := loadCache(cfg)
+	if err != nil {
+		return false, err
+	}
+	if cache.ETag == "" {
+		return false, errNoETag
+	}
+
+	_, _, err = cfg.Session.Watch(ctx, "/client/watch", cache.ETag, timeout)
+	switch err {
+	case nil:
+		return true, nil
+	case shared.ErrNotModified:
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,83 @@
+package functions
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jfindley/skds/shared"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Crypto.Cache = filepath.Join(dir, "cache.json")
+	defer func() {
+		cfg.Startup.Crypto.Cache = ""
+	}()
+
+	_, err = Watch(context.Background(), cfg, time.Minute)
+	if err == nil {
+		t.Error("Watched without any cached secrets")
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get(shared.HdrIfNoneMatch) {
+		case `"current"`:
+			if r.Header.Get(shared.HdrWatchTimeout) != "60" {
+				t.Error("Watch timeout not sent:", r.Header.Get(shared.HdrWatchTimeout))
+			}
+			w.WriteHeader(http.StatusNotModified)
+		case `"waiting"`:
+			<-r.Context().Done()
+		}
+	}))
+	defer ts.Close()
+
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+	cfg.Session.New(cfg)
+
+	saveCache(cfg, nil, `"current"`)
+
+	changed, err := Watch(context.Background(), cfg, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Change reported on timeout")
+	}
+
+	saveCache(cfg, nil, `"old"`)
+
+	changed, err = Watch(context.Background(), cfg, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Change not reported")
+	}
+
+	saveCache(cfg, nil, `"waiting"`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = Watch(ctx, cfg, time.Minute)
+	if err == nil {
+		t.Error("Cancelled watch did not return an error")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Watch not cancelled")
+	}
+}
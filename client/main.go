@@ -16,10 +16,38 @@ import (
 
 var cfgFile string
 var version bool
+var daemonMode bool
+var dryRun bool
+var token string
+var reportFormat string
+
+// Exit codes of a single run, so that tools wrapping the client can tell what
+// happened without reading the log.
+const (
+	exitUnchanged = 0 // Nothing needed changing
+	exitFatal     = 1 // Nothing could be applied.  Also used by cfg.Fatal
+	exitUsage     = 2
+	exitChanged   = 3 // Changes were applied
+	exitPartial   = 4 // Some secrets, templates or hooks failed
+	exitOffline   = 5 // The server could not be reached, cached secrets were applied
+)
 
 func init() {
 	flag.StringVar(&cfgFile, "f", "/etc/skds/client.conf", "Config file location.")
 	flag.BoolVar(&version, "V", false, "Show version")
+	flag.BoolVar(&daemonMode, "d", false, "Run as a daemon, polling the server for changes")
+	flag.BoolVar(&dryRun, "n", false, "Report what would change, without writing anything")
+	flag.BoolVar(&dryRun, "dry-run", false, "Same as -n")
+	flag.StringVar(&token, "t", "", "Enrollment token used to register with the server")
+	flag.StringVar(&reportFormat, "report", "", "Print a report of the run to stdout in this format (json)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [rotate | exec -- command [args...]]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "\nA single run exits with 0 if nothing needed changing, 3 if changes were applied,")
+		fmt.Fprintln(os.Stderr, "4 if some secrets, templates or hooks failed, 5 if the server could not be reached")
+		fmt.Fprintln(os.Stderr, "and cached secrets were applied, and 1 if nothing could be applied.")
+	}
 }
 
 func readFiles(cfg *shared.Config) (install bool, err error) {
@@ -60,19 +88,77 @@ func main() {
 		os.Exit(0)
 	}
 
+	if dryRun && daemonMode {
+		fmt.Println("Dry-run mode cannot be used with daemon mode")
+		os.Exit(exitUsage)
+	}
+
+	if reportFormat != "" && reportFormat != "json" {
+		fmt.Println("Unsupported report format:", reportFormat)
+		os.Exit(exitUsage)
+	}
+	if reportFormat != "" && (daemonMode || flag.NArg() > 0) {
+		fmt.Println("Reports can only be printed for a single run")
+		os.Exit(exitUsage)
+	}
+
+	// skds-client rotate
+	rotate := flag.NArg() > 0 && flag.Arg(0) == "rotate"
+	if rotate {
+		if flag.NArg() > 1 || dryRun || daemonMode {
+			fmt.Println("Usage: skds-client rotate")
+			os.Exit(exitUsage)
+		}
+	}
+
+	// skds-client exec [--] command [args...]
+	var execArgs []string
+	if flag.NArg() > 0 && !rotate {
+		if flag.Arg(0) != "exec" {
+			fmt.Println("Unknown command:", flag.Arg(0))
+			os.Exit(exitUsage)
+		}
+		execArgs = flag.Args()[1:]
+		if len(execArgs) > 0 && execArgs[0] == "--" {
+			execArgs = execArgs[1:]
+		}
+		if len(execArgs) == 0 {
+			fmt.Println("Usage: skds-client exec -- command [args...]")
+			os.Exit(exitUsage)
+		}
+		if dryRun || daemonMode {
+			fmt.Println("Exec mode cannot be used with daemon or dry-run mode")
+			os.Exit(exitUsage)
+		}
+	}
+
 	cfg := new(shared.Config)
 	cfg.NewClient()
+	cfg.Runtime.DryRun = dryRun
+	cfg.Runtime.Exec = execArgs != nil
 
 	err := shared.Read(cfg, cfgFile)
 	if err != nil {
 		fmt.Println("Cannot read config file:", err)
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+
+	if token != "" {
+		cfg.Startup.Client.Token = token
+	}
+
+	// Keep stdout for the report.
+	if reportFormat != "" {
+		if cfg.Startup.LogFile == "" {
+			cfg.Startup.LogFile = "/dev/stderr"
+		}
+		functions.SetDryRunOutput(os.Stderr)
 	}
 
 	err = cfg.StartLogging()
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
 
 	cfg.Log(log.DEBUG, "Reading keys and certificates from disk")
@@ -85,9 +171,21 @@ func main() {
 		cfg.Log(log.WARN, "Server certificate pinning disabled.  This is strongly discouraged.\n",
 			"Please consider configuring a ServerCert location.")
 	}
+	if len(cfg.Startup.Client.AllowedPaths) == 0 {
+		cfg.Log(log.WARN, "No AllowedPaths configured, secrets may be written anywhere.\n",
+			"Please consider restricting them to the directories your secrets belong in.")
+	}
 
 	cfg.Session.New(cfg)
 
+	if install && dryRun {
+		cfg.Fatal("This client has not been registered yet, there is nothing to compare against")
+	}
+
+	if install && rotate {
+		cfg.Fatal("This client has not been registered yet, there is nothing to rotate")
+	}
+
 	if install {
 		cfg.Log(log.INFO, "Performing first-run install")
 		err = setup(cfg)
@@ -96,12 +194,59 @@ func main() {
 		}
 	}
 
-	err = cfg.Session.Login(cfg)
-	if err != nil {
-		cfg.Fatal(err)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	if execArgs != nil {
+		os.Exit(execCommand(cfg, execArgs))
 	}
 
-	sigs := make(chan os.Signal, 1)
+	if rotate {
+		err = functions.Login(cfg)
+		if err != nil {
+			cfg.Fatal(err)
+		}
+
+		ok := functions.Rotate(cfg)
+
+		err = cfg.Session.Logout(cfg)
+		if err != nil {
+			cfg.Log(log.WARN, "Logout failed:", err)
+		}
+
+		if !ok {
+			os.Exit(exitFatal)
+		}
+		return
+	}
+
+	if daemonMode {
+		daemon(cfg, sigs)
+
+		if cfg.Session.Active() {
+			err = cfg.Session.Logout(cfg)
+			if err != nil {
+				cfg.Log(log.WARN, "Logout failed:", err)
+			}
+		}
+		return
+	}
+
+	rep := new(functions.Report)
+
+	err = functions.Login(cfg)
+	switch {
+	case shared.IsConnError(err):
+		cfg.Log(log.ERROR, err)
+		cfg.Runtime.Offline = true
+		rep.Login = functions.LoginOffline
+	case err != nil:
+		cfg.Log(log.ERROR, err)
+		rep.Login = functions.LoginFailed
+		finish(rep)
+	default:
+		rep.Login = functions.LoginOK
+	}
 
 	go func() {
 		<-sigs
@@ -110,15 +255,40 @@ func main() {
 		os.Exit(0)
 	}()
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	functions.GetSecretsReport(cfg, rep)
 
-	ok := functions.GetSecrets(cfg)
-	if !ok {
-		os.Exit(1)
+	if !cfg.Runtime.Offline {
+		err = cfg.Session.Logout(cfg)
+		if err != nil {
+			cfg.Log(log.WARN, "Logout failed:", err)
+		}
 	}
 
-	err = cfg.Session.Logout(cfg)
-	if err != nil {
-		cfg.Fatal(err)
+	finish(rep)
+}
+
+// finish prints the report of a single run if one was asked for, and exits
+// with the code matching its result.  Runs that could only apply cached
+// secrets exit with exitOffline, whatever else happened.
+func finish(rep *functions.Report) {
+	result := rep.Finish()
+
+	if reportFormat != "" {
+		err := rep.Write(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to write report:", err)
+		}
+	}
+
+	switch {
+	case result == functions.ResultFatal:
+		os.Exit(exitFatal)
+	case rep.Login == functions.LoginOffline:
+		os.Exit(exitOffline)
+	case result == functions.ResultChanged:
+		os.Exit(exitChanged)
+	case result == functions.ResultPartial:
+		os.Exit(exitPartial)
 	}
+	os.Exit(exitUnchanged)
 }
@@ -25,6 +25,7 @@ const (
 	scryptR        = 8
 	scryptP        = 8
 	scryptLen      = 32
+	tokenLength    = 32
 	// This is just for auto-generated registration passwords
 	// We include numbers twice to even the odds between the character classes a bit
 	passwordChars = "01234567890123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
@@ -67,6 +68,32 @@ func makeHash(pass, salt []byte) (hash []byte, err error) {
 	return
 }
 
+// NewToken generates a random token, such as a client enrollment token.
+// Tokens are URL-safe base64 encoded, so they can be pasted into config files
+// and command lines without quoting.
+func NewToken() (token string, err error) {
+	buf := make([]byte, tokenLength)
+	_, err = io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// TokenHash returns the hash of a token, for storage.  Tokens are random, so
+// unlike passwords they do not need to be salted or stretched.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Fingerprint returns a short string identifying a public key, so that it can
+// be compared by eye.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
 func generateSalt() (salt []byte, err error) {
 	salt = make([]byte, saltLength)
 	_, err = io.ReadFull(rand.Reader, salt)
@@ -36,6 +36,35 @@ func TestPasswordHash(t *testing.T) {
 	}
 }
 
+func TestNewToken(t *testing.T) {
+	token1, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token2, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token1 == token2 {
+		t.Error("Tokens are not random")
+	}
+
+	if TokenHash(token1) == TokenHash(token2) || TokenHash(token1) != TokenHash(token1) {
+		t.Error("Bad token hash")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	if Fingerprint([]byte("key one")) == Fingerprint([]byte("key two")) {
+		t.Error("Different keys have the same fingerprint")
+	}
+
+	if !strings.HasPrefix(Fingerprint([]byte("key one")), "SHA256:") {
+		t.Error("Bad fingerprint format")
+	}
+}
+
 func TestNewPassword(t *testing.T) {
 	pass, err := NewPassword()
 	if err != nil {
@@ -53,10 +53,24 @@ var Dictionary = map[string]APIFunc{
 	"/admin/group/delete": GroupDel,
 	"/admin/group/list":   GroupList,
 
+	"/audit/query": AuditQuery,
+
 	"/ca": GetCA,
 
-	"/client/register": ClientRegister,
-	"/client/secrets":  ClientGetSecret,
+	"/client/register":     ClientRegister,
+	"/client/secrets":      ClientGetSecret,
+	"/client/status":       ClientStatus,
+	"/client/watch":        ClientWatch,
+	"/client/rotate":       ClientRotate,
+	"/client/rekey":        ClientRekey,
+	"/client/rekey/get":    ClientRekeyGet,
+	"/client/token/create": ClientTokenCreate,
+	"/client/list":         ClientList,
+	"/client/prune":        ClientPrune,
+
+	"/client/pending/list":    ClientPendingList,
+	"/client/pending/approve": ClientPendingApprove,
+	"/client/pending/reject":  ClientPendingReject,
 
 	"/key/public/get/user":    UserPubKey,
 	"/key/public/get/group":   GroupPubKey,
@@ -67,10 +81,15 @@ var Dictionary = map[string]APIFunc{
 	"/key/private/get/secret": SecretPrivKey,
 	"/key/private/set/super":  SetSuperKey,
 
-	"/secret/create": SecretNew,
-	"/secret/get":    SecretGet,
-	"/secret/delete": SecretDel,
-	"/secret/update": SecretUpdate,
+	"/secret/create":   SecretNew,
+	"/secret/get":      SecretGet,
+	"/secret/delete":   SecretDel,
+	"/secret/update":   SecretUpdate,
+	"/secret/edit":     SecretEdit,
+	"/secret/expiry":   SecretExpiry,
+	"/secret/history":  SecretHistory,
+	"/secret/rollback": SecretRollback,
+	"/secret/status":   SecretStatusList,
 
 	"/secret/list/all":   SecretList,
 	"/secret/list/user":  SecretListUser,
@@ -91,6 +110,26 @@ var secret = cli.StringFlag{Name: "secret, s", Usage: "secret name"}
 var file = cli.StringFlag{Name: "file, f", Usage: "filename"}
 var path = cli.StringFlag{Name: "path, p", Usage: "path secret will be saved at on clients"}
 var isadmin = cli.BoolFlag{Name: "admin, a", Usage: "applies to admins, not clients"}
+var owner = cli.StringFlag{Name: "owner, o", Usage: "user that will own the secret file on clients"}
+var fileGroup = cli.StringFlag{Name: "group, g", Usage: "group that will own the secret file on clients"}
+var mode = cli.StringFlag{Name: "mode, m", Usage: "permissions of the secret file on clients, in octal"}
+var command = cli.StringFlag{Name: "command, c", Usage: "command run on clients after the secret file changes, if they allow it"}
+var uses = cli.IntFlag{Name: "uses, u", Value: 1, Usage: "number of clients that may register with the token"}
+var expiry = cli.StringFlag{Name: "expiry, e", Value: "24h", Usage: "how long the token is valid for, e.g. 30m or 24h"}
+var days = cli.IntFlag{Name: "days, d", Usage: "only clients not seen for this many days"}
+var env = cli.StringFlag{Name: "env, e", Usage: "environment variable the secret is exported as by skds-client exec"}
+var actor = cli.StringFlag{Name: "actor, u", Usage: "only requests made by this user or client"}
+var since = cli.StringFlag{Name: "since", Usage: "only requests since this time, as a date (2006-01-02), an RFC3339 time or a duration ago, e.g. 24h"}
+var until = cli.StringFlag{Name: "until", Usage: "only requests before this time, in the same formats as --since"}
+var limit = cli.IntFlag{Name: "limit, l", Value: 100, Usage: "show at most this many of the newest requests, 0 for all"}
+var version = cli.IntFlag{Name: "version, v", Usage: "version of the secret, as shown by 'secret history'"}
+var description = cli.StringFlag{Name: "description, d", Usage: "description of the secret"}
+var tags = cli.StringFlag{Name: "tags, t", Usage: "comma separated tags"}
+var team = cli.StringFlag{Name: "team", Usage: "team that owns the secret"}
+var expires = cli.StringFlag{Name: "expires", Usage: "date the secret must be rotated by (2006-01-02), an RFC3339 time or a duration from now, e.g. 720h"}
+var rotate = cli.IntFlag{Name: "rotate, r", Usage: "rotation period in days; updating the secret moves its expiry date on by this"}
+var within = cli.IntFlag{Name: "days, d", Usage: "also list secrets expiring within this many days"}
+var sink = cli.StringFlag{Name: "sink", Usage: "format the secret is written in on clients: raw (default), dotenv, json or pem"}
 
 // Misc functions
 
@@ -100,6 +139,18 @@ var GetCA = APIFunc{
 	Description: "Display the server CA",
 }
 
+// Audit functions
+
+var AuditQuery = APIFunc{
+	Serverfn:     server.AuditQuery,
+	Adminfn:      admin.AuditQuery,
+	Flags:        []cli.Flag{actor, secret, since, until, limit},
+	AuthRequired: true,
+	AdminOnly:    true,
+	SuperOnly:    true,
+	Description:  "Show the log of API requests",
+}
+
 // Admin functions
 
 var AdminPass = APIFunc{
@@ -195,11 +246,101 @@ var ClientGetSecret = APIFunc{
 	Description:  "Download keys assigned to this client",
 }
 
+var ClientStatus = APIFunc{
+	Serverfn:     server.ClientStatus,
+	AuthRequired: true,
+	Description:  "Report the result of applying secrets on this client",
+}
+
+var ClientWatch = APIFunc{
+	Serverfn:     server.ClientWatch,
+	AuthRequired: true,
+	Description:  "Wait until the secrets of this client change",
+}
+
+var ClientRotate = APIFunc{
+	Serverfn:     server.ClientRotate,
+	AuthRequired: true,
+	Description:  "Replace the password and keypair of this client",
+}
+
+var ClientRekey = APIFunc{
+	Serverfn:     server.ClientRekey,
+	Adminfn:      admin.ClientRekey,
+	Flags:        []cli.Flag{name},
+	AuthRequired: true,
+	AdminOnly:    true,
+	SuperOnly:    true,
+	Description:  "Re-encrypt the secrets of a client that has rotated its keypair",
+}
+
+var ClientRekeyGet = APIFunc{
+	Serverfn:     server.ClientRekeyGet,
+	AuthRequired: true,
+	AdminOnly:    true,
+	SuperOnly:    true,
+	Description:  "Get the new public key and secrets of a client that has rotated its keypair",
+}
+
 var ClientRegister = APIFunc{
 	Serverfn:    server.ClientRegister,
 	Description: "Register a new client",
 }
 
+var ClientTokenCreate = APIFunc{
+	Serverfn:     server.ClientTokenCreate,
+	Adminfn:      admin.ClientTokenCreate,
+	Flags:        []cli.Flag{group, uses, expiry},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "Create an enrollment token for registering clients",
+}
+
+var ClientList = APIFunc{
+	Serverfn:     server.ClientList,
+	Adminfn:      admin.ClientList,
+	Flags:        []cli.Flag{days},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "List clients, and when they were last seen",
+}
+
+var ClientPrune = APIFunc{
+	Serverfn:     server.ClientPrune,
+	Adminfn:      admin.ClientPrune,
+	Flags:        []cli.Flag{days},
+	AuthRequired: true,
+	AdminOnly:    true,
+	SuperOnly:    true,
+	Description:  "Delete clients that have not been seen for a number of days",
+}
+
+var ClientPendingList = APIFunc{
+	Serverfn:     server.ClientPendingList,
+	Adminfn:      admin.ClientPendingList,
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "List clients awaiting approval",
+}
+
+var ClientPendingApprove = APIFunc{
+	Serverfn:     server.ClientPendingApprove,
+	Adminfn:      admin.ClientPendingApprove,
+	Flags:        []cli.Flag{name},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "Approve a client awaiting approval",
+}
+
+var ClientPendingReject = APIFunc{
+	Serverfn:     server.ClientPendingReject,
+	Adminfn:      admin.ClientPendingReject,
+	Flags:        []cli.Flag{name},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "Reject and delete a client awaiting approval",
+}
+
 // Key functions - these are rarely called directly, and are usually called
 // as part of some other action.
 
@@ -267,6 +408,7 @@ var SetSuperKey = APIFunc{
 var SecretList = APIFunc{
 	Serverfn:     server.SecretList,
 	Adminfn:      admin.SecretList,
+	Flags:        []cli.Flag{team, tags},
 	AuthRequired: true,
 	AdminOnly:    true,
 	Description:  "list all secrets",
@@ -275,7 +417,7 @@ var SecretList = APIFunc{
 var SecretListUser = APIFunc{
 	Serverfn:     server.SecretListUser,
 	Adminfn:      admin.SecretListUser,
-	Flags:        []cli.Flag{name, isadmin},
+	Flags:        []cli.Flag{name, isadmin, team, tags},
 	AuthRequired: true,
 	AdminOnly:    true,
 	Description:  "List all secrets for a user",
@@ -284,7 +426,7 @@ var SecretListUser = APIFunc{
 var SecretListGroup = APIFunc{
 	Serverfn:     server.SecretListGroup,
 	Adminfn:      admin.SecretListUser,
-	Flags:        []cli.Flag{name, isadmin},
+	Flags:        []cli.Flag{name, isadmin, team, tags},
 	AuthRequired: true,
 	AdminOnly:    true,
 	Description:  "List all secrets for a group",
@@ -293,7 +435,7 @@ var SecretListGroup = APIFunc{
 var SecretNew = APIFunc{
 	Serverfn:     server.SecretNew,
 	Adminfn:      admin.SecretNew,
-	Flags:        []cli.Flag{name, file},
+	Flags:        []cli.Flag{name, file, description, tags, team, expires, rotate},
 	AuthRequired: true,
 	AdminOnly:    true,
 	Description:  "Add a new secret",
@@ -301,11 +443,58 @@ var SecretNew = APIFunc{
 
 var SecretGet = APIFunc{
 	Serverfn:     server.SecretGet,
+	Adminfn:      admin.SecretGet,
+	Flags:        []cli.Flag{name, version, file},
 	AuthRequired: true,
 	AdminOnly:    true,
 	Description:  "Download a secret",
 }
 
+var SecretEdit = APIFunc{
+	Serverfn:     server.SecretEdit,
+	Adminfn:      admin.SecretEdit,
+	Flags:        []cli.Flag{name, description, tags, team, expires, rotate},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "Change the description, tags, team or expiry of a secret",
+}
+
+var SecretExpiry = APIFunc{
+	Serverfn:     server.SecretExpiry,
+	Adminfn:      admin.SecretExpiry,
+	Flags:        []cli.Flag{within, team, tags},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "List secrets that are past their expiry date, or will be soon",
+}
+
+var SecretHistory = APIFunc{
+	Serverfn:     server.SecretHistory,
+	Adminfn:      admin.SecretHistory,
+	Flags:        []cli.Flag{name},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "List the stored versions of a secret",
+}
+
+var SecretRollback = APIFunc{
+	Serverfn:     server.SecretRollback,
+	Adminfn:      admin.SecretRollback,
+	Flags:        []cli.Flag{name, version},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "Make an earlier version of a secret the current one",
+}
+
+var SecretStatusList = APIFunc{
+	Serverfn:     server.SecretStatusList,
+	Adminfn:      admin.SecretStatusList,
+	Flags:        []cli.Flag{name},
+	AuthRequired: true,
+	AdminOnly:    true,
+	Description:  "Show which clients have applied the current version of a secret",
+}
+
 var SecretDel = APIFunc{
 	Serverfn:     server.SecretDel,
 	Adminfn:      admin.SecretDel,
@@ -327,7 +516,7 @@ var SecretUpdate = APIFunc{
 var SecretAssignUser = APIFunc{
 	Serverfn:     server.SecretAssignUser,
 	Adminfn:      admin.SecretAssignUser,
-	Flags:        []cli.Flag{name, secret, isadmin, path},
+	Flags:        []cli.Flag{name, secret, isadmin, path, owner, fileGroup, mode, command, env, sink},
 	AuthRequired: true,
 	AdminOnly:    true,
 	SuperOnly:    true,
@@ -337,7 +526,7 @@ var SecretAssignUser = APIFunc{
 var SecretAssignGroup = APIFunc{
 	Serverfn:     server.SecretAssignGroup,
 	Adminfn:      admin.SecretAssignGroup,
-	Flags:        []cli.Flag{name, secret, isadmin, path},
+	Flags:        []cli.Flag{name, secret, isadmin, path, owner, fileGroup, mode, command, env, sink},
 	AuthRequired: true,
 	AdminOnly:    true,
 	Description:  "Assign a secret to a group",
@@ -0,0 +1,19 @@
+// +build linux darwin
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/jfindley/skds/server/functions"
+	"github.com/jfindley/skds/shared"
+)
+
+// audit records requests made to endpoint in the audit log.
+func audit(cfg *shared.Config, endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := functions.NewAuditRecorder(w)
+		handler(rec, r)
+		rec.Save(cfg, endpoint, remoteAddr(r))
+	}
+}
@@ -18,7 +18,7 @@ import (
 
 var (
 	// sessionExpiry is measured in seconds.
-	sessionExpiry = 1800
+	sessionExpiry = int(shared.SessionExpiry / time.Second)
 	pruneInterval = 90 * time.Second
 )
 
@@ -71,6 +71,13 @@ func (s *SessionInfo) NextKey() crypto.Binary {
 	return s.SessionKey
 }
 
+// Touch resets the expiry time of a session, without rotating its key.
+func (s *SessionInfo) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.SessionTime = time.Now()
+}
+
 func (s *SessionInfo) GetName() string {
 	return s.Name
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/mattn/go-sqlite3"
 	"strings"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/shared"
@@ -44,6 +45,18 @@ type Users struct {
 	Password []byte
 	GroupKey []byte
 	Admin    bool
+	// Clients registered without a token cannot log in until approved.
+	Pending    bool
+	RegAddress string // Address the client registered from
+	// Updated whenever a user logs in or a client fetches its secrets.
+	LastSeen    time.Time
+	LastAddress string
+	Version     string
+	// Incremented whenever the secrets delivered to this user change.
+	Serial uint64
+	// Set when a client rotates its keypair, until an admin has re-encrypted
+	// its secrets with the new key.
+	NextPubKey []byte
 }
 
 func (_ Users) TableName() string {
@@ -70,6 +83,71 @@ func (u *Users) Get(db gorm.DB, name string) error {
 	return q.Error
 }
 
+// Seen records that a user has been seen from addr, running the given
+// version of SKDS.
+func (u *Users) Seen(db gorm.DB, addr, version string) error {
+	u.LastSeen = time.Now()
+	u.LastAddress = addr
+	u.Version = version
+
+	q := db.Model(u).UpdateColumns(map[string]interface{}{
+		"last_seen":    u.LastSeen,
+		"last_address": u.LastAddress,
+		"version":      u.Version,
+	})
+	return q.Error
+}
+
+// UsersChanged increments the serial of each user, so that their clients
+// fetch their secrets again, and wakes any of them that are watching.
+func UsersChanged(db gorm.DB, uids ...uint) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	q := db.Model(&Users{}).Where("id in (?)", uids).UpdateColumn("serial", gorm.Expr("serial + 1"))
+	if q.Error != nil {
+		return q.Error
+	}
+	notifyWatchers(uids, nil)
+	return nil
+}
+
+// GroupsChanged increments the serial of each group, so that the clients in
+// them fetch their secrets again.
+func GroupsChanged(db gorm.DB, gids ...uint) error {
+	if len(gids) == 0 {
+		return nil
+	}
+	q := db.Model(&Groups{}).Where("id in (?)", gids).UpdateColumn("serial", gorm.Expr("serial + 1"))
+	if q.Error != nil {
+		return q.Error
+	}
+	notifyWatchers(nil, gids)
+	return nil
+}
+
+// SecretChanged increments the serial of every user and group a secret is
+// assigned to.
+func SecretChanged(db gorm.DB, sid uint) error {
+	var uids, gids []uint
+
+	q := db.Model(&UserSecrets{}).Where("sid = ?", sid).Pluck("uid", &uids)
+	if q.Error != nil && !q.RecordNotFound() {
+		return q.Error
+	}
+
+	q = db.Model(&GroupSecrets{}).Where("sid = ?", sid).Pluck("gid", &gids)
+	if q.Error != nil && !q.RecordNotFound() {
+		return q.Error
+	}
+
+	err := UsersChanged(db, uids...)
+	if err != nil {
+		return err
+	}
+	return GroupsChanged(db, gids...)
+}
+
 // Functions to statisfy the auth credentials interface.
 func (u *Users) GetName() string {
 	return u.Name
@@ -128,11 +206,17 @@ func (u *Users) BeforeCreate() (err error) {
 // Unencrypted passwords never get as far as these functions either.
 
 type UserSecrets struct {
-	Id     uint
-	SID    uint   `gorm:"column:sid"`
-	UID    uint   `gorm:"column:uid"`
-	Path   string `sql:"type:varchar(2048)"`
-	Secret []byte
+	Id        uint
+	SID       uint   `gorm:"column:sid"`
+	UID       uint   `gorm:"column:uid"`
+	Path      string `sql:"type:varchar(2048)"`
+	FileOwner string
+	FileGroup string
+	FileMode  uint32
+	Command   string `sql:"type:varchar(2048)"`
+	Env       string
+	Sink      string
+	Secret    []byte
 }
 
 func (_ UserSecrets) TableName() string {
@@ -140,9 +224,20 @@ func (_ UserSecrets) TableName() string {
 }
 
 type MasterSecrets struct {
-	Id     uint
-	Name   string `sql:"not null;unique"`
-	Secret []byte `sql:"type:blob"` // Unlimited size
+	Id      uint
+	Name    string `sql:"not null;unique"`
+	Secret  []byte `sql:"type:blob"` // Unlimited size
+	Version int    // The current version in SecretVersions
+	// Metadata is not encrypted.
+	Description string `sql:"type:varchar(2048)"`
+	Tags        string `sql:"type:varchar(2048)"` // Comma separated
+	Team        string
+	Created     time.Time
+	CreatedBy   string
+	Updated     time.Time
+	UpdatedBy   string
+	Expires     time.Time // Zero if the secret does not expire
+	RotateDays  int
 }
 
 // Lookup just checks if a user has any form of access to a key.
@@ -163,12 +258,106 @@ func (_ MasterSecrets) TableName() string {
 	return "MasterSecrets"
 }
 
+// Meta returns the metadata of a secret.
+func (m MasterSecrets) Meta() (meta shared.SecretMeta) {
+	meta.Description = m.Description
+	if m.Tags != "" {
+		meta.Tags = strings.Split(m.Tags, ",")
+	}
+	meta.Team = m.Team
+	if !m.Created.IsZero() {
+		meta.Created = m.Created.Unix()
+	}
+	meta.CreatedBy = m.CreatedBy
+	if !m.Updated.IsZero() {
+		meta.Updated = m.Updated.Unix()
+	}
+	meta.UpdatedBy = m.UpdatedBy
+	if !m.Expires.IsZero() {
+		meta.Expires = m.Expires.Unix()
+	}
+	meta.RotateDays = m.RotateDays
+	return
+}
+
+// SetMeta sets the metadata admins may edit.  Timestamps are not changed.
+func (m *MasterSecrets) SetMeta(meta shared.SecretMeta) {
+	m.Description = meta.Description
+	m.Tags = strings.Join(meta.Tags, ",")
+	m.Team = meta.Team
+	m.Expires = time.Time{}
+	if meta.Expires > 0 {
+		m.Expires = time.Unix(meta.Expires, 0)
+	}
+	m.RotateDays = meta.RotateDays
+}
+
+// Rotated moves the expiry date of a secret on by its rotation period, if it
+// has one.
+func (m *MasterSecrets) Rotated(now time.Time) {
+	if m.RotateDays > 0 {
+		m.Expires = now.AddDate(0, 0, m.RotateDays)
+	}
+}
+
+// Expired returns true if a secret has an expiry date, and it has passed.
+func (m MasterSecrets) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !m.Expires.After(now)
+}
+
+// NewVersion stores secret as the next version of m, and makes it current.
+// The expiry date is saved too, so that callers may change it.
+func (m *MasterSecrets) NewVersion(db gorm.DB, secret []byte, actor string) error {
+	version := SecretVersions{
+		SID:     m.Id,
+		Version: m.Version + 1,
+		Secret:  secret,
+		Actor:   actor,
+		Time:    time.Now(),
+	}
+
+	q := db.Create(&version)
+	if q.Error != nil {
+		return q.Error
+	}
+
+	m.Secret = secret
+	m.Version = version.Version
+	m.Updated = version.Time
+	m.UpdatedBy = actor
+
+	q = db.Model(m).UpdateColumns(map[string]interface{}{
+		"secret":     m.Secret,
+		"version":    m.Version,
+		"updated":    m.Updated,
+		"updated_by": m.UpdatedBy,
+		"expires":    m.Expires,
+	})
+	return q.Error
+}
+
+// SecretVersions holds every version of each secret, so that updates can be
+// rolled back.  Versions are numbered from 1 for each secret.
+type SecretVersions struct {
+	Id      uint
+	SID     uint `gorm:"column:sid"`
+	Version int
+	Secret  []byte `sql:"type:blob"`
+	Actor   string
+	Time    time.Time
+}
+
+func (_ SecretVersions) TableName() string {
+	return "SecretVersions"
+}
+
 type Groups struct {
 	Id      uint
 	Name    string
 	Admin   bool
 	PubKey  []byte
 	PrivKey []byte // Key encrypted with supergroup key
+	Serial  uint64 // Incremented whenever the secrets assigned to this group change
 }
 
 func (g Groups) Lookup(db gorm.DB, uid, gid uint) bool {
@@ -184,33 +373,96 @@ func (_ Groups) TableName() string {
 }
 
 type GroupSecrets struct {
-	Id     uint
-	GID    uint `gorm:"column:gid"`
-	SID    uint `gorm:"column:sid"`
-	Secret []byte
-	Path   string `sql:"type:varchar(2048)"`
+	Id        uint
+	GID       uint `gorm:"column:gid"`
+	SID       uint `gorm:"column:sid"`
+	Secret    []byte
+	Path      string `sql:"type:varchar(2048)"`
+	FileOwner string
+	FileGroup string
+	FileMode  uint32
+	Command   string `sql:"type:varchar(2048)"`
+	Env       string
+	Sink      string
 }
 
 func (_ GroupSecrets) TableName() string {
 	return "GroupSecrets"
 }
 
+// EnrollTokens allow new clients to register.  Only a hash of each token is
+// stored, and a token is deleted once it has been used Uses times.
+// Clients registered with a token are placed in group GID, if set.
+type EnrollTokens struct {
+	Id      uint
+	Hash    string `sql:"not null;unique"`
+	GID     uint   `gorm:"column:gid"`
+	Uses    int
+	Expires time.Time
+}
+
+func (_ EnrollTokens) TableName() string {
+	return "EnrollTokens"
+}
+
+// SecretStatus is the last reported state of a secret on a client.
+// Hash identifies the version of the secret the client applied.
+type SecretStatus struct {
+	Id     uint
+	UID    uint   `gorm:"column:uid"`
+	SID    uint   `gorm:"column:sid"`
+	Path   string `sql:"type:varchar(2048)"`
+	Hash   string
+	Result string
+	Hook   string
+	Error  string `sql:"type:varchar(2048)"`
+	Time   time.Time
+}
+
+func (_ SecretStatus) TableName() string {
+	return "SecretStatus"
+}
+
+// AuditLog records every API request: who made it, what it was for and how
+// it was answered.  Only names are recorded, never request data.
+type AuditLog struct {
+	Id       uint
+	Actor    string
+	UID      uint `gorm:"column:uid"`
+	GID      uint `gorm:"column:gid"`
+	Endpoint string
+	Secret   string
+	Targets  string `sql:"type:varchar(2048)"` // Comma separated
+	Code     int
+	Address  string
+	Time     time.Time
+}
+
+func (_ AuditLog) TableName() string {
+	return "AuditLog"
+}
+
 // A list of all DB tables
 
 var tableList = map[string]interface{}{
-	"UserACLs":      UserACLs{},
-	"GroupACLs":     GroupACLs{},
-	"Users":         Users{},
-	"UserSecrets":   UserSecrets{},
-	"MasterSecrets": MasterSecrets{},
-	"Groups":        Groups{},
-	"GroupSecrets":  GroupSecrets{},
+	"UserACLs":       UserACLs{},
+	"GroupACLs":      GroupACLs{},
+	"Users":          Users{},
+	"UserSecrets":    UserSecrets{},
+	"MasterSecrets":  MasterSecrets{},
+	"SecretVersions": SecretVersions{},
+	"Groups":         Groups{},
+	"GroupSecrets":   GroupSecrets{},
+	"EnrollTokens":   EnrollTokens{},
+	"SecretStatus":   SecretStatus{},
+	"AuditLog":       AuditLog{},
 }
 
 var compoundIndexes = map[string][]string{
-	"UserSecrets":  []string{"SID", "UID"},
-	"Groups":       []string{"Name", "Admin"},
-	"GroupSecrets": []string{"GID", "SID"},
+	"UserSecrets":    []string{"SID", "UID"},
+	"Groups":         []string{"Name", "Admin"},
+	"GroupSecrets":   []string{"GID", "SID"},
+	"SecretVersions": []string{"SID", "Version"},
 }
 
 func Connect(cfg shared.DBSettings) (db gorm.DB, err error) {
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"sync"
+)
+
+// A watcher is a client waiting for the secrets of a user or group to change.
+type watcher struct {
+	uid     uint
+	gid     uint
+	changed chan struct{}
+	once    sync.Once
+}
+
+func (w *watcher) notify() {
+	w.once.Do(func() {
+		close(w.changed)
+	})
+}
+
+var (
+	watchMu  sync.Mutex
+	watchers = make(map[*watcher]bool)
+)
+
+// Watch returns a channel that is closed the next time the secrets of user
+// uid or group gid change.  Cancel must be called once the caller has
+// finished waiting.
+// Only changes made by this server are seen, so with more than one server
+// callers should not wait indefinitely.
+func Watch(uid, gid uint) (changed <-chan struct{}, cancel func()) {
+	w := &watcher{uid: uid, gid: gid, changed: make(chan struct{})}
+
+	watchMu.Lock()
+	watchers[w] = true
+	watchMu.Unlock()
+
+	cancel = func() {
+		watchMu.Lock()
+		delete(watchers, w)
+		watchMu.Unlock()
+	}
+
+	return w.changed, cancel
+}
+
+// notifyWatchers wakes everyone watching any of the given users or groups.
+func notifyWatchers(uids, gids []uint) {
+	users := make(map[uint]bool)
+	for _, id := range uids {
+		users[id] = true
+	}
+	groups := make(map[uint]bool)
+	for _, id := range gids {
+		groups[id] = true
+	}
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for w := range watchers {
+		if users[w.uid] || groups[w.gid] {
+			w.notify()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package functions
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jfindley/skds/log"
+	"github.com/jfindley/skds/server/db"
+	"github.com/jfindley/skds/shared"
+)
+
+/*
+Query.Actor => only entries for requests made by this user (optional)
+Query.Secret => only entries for requests about this secret (optional)
+Query.Since => only entries at or after this Unix time (optional)
+Query.Until => only entries before this Unix time (optional)
+Query.Limit => return at most this many of the newest entries (optional)
+*/
+func AuditQuery(cfg *shared.Config, r shared.Request) {
+	var entries []db.AuditLog
+	var msg shared.Message
+
+	if r.Req.Query.Limit < 0 {
+		r.Reply(400, shared.RespMessage("Invalid limit"))
+		return
+	}
+
+	if r.Req.Query.Since > 0 && r.Req.Query.Until > 0 && r.Req.Query.Until <= r.Req.Query.Since {
+		r.Reply(400, shared.RespMessage("Invalid time range"))
+		return
+	}
+
+	q := cfg.DB.Order("id desc")
+	if r.Req.Query.Actor != "" {
+		q = q.Where("actor = ?", r.Req.Query.Actor)
+	}
+	if r.Req.Query.Secret != "" {
+		q = q.Where("secret = ?", r.Req.Query.Secret)
+	}
+	if r.Req.Query.Since > 0 {
+		q = q.Where("time >= ?", time.Unix(r.Req.Query.Since, 0))
+	}
+	if r.Req.Query.Until > 0 {
+		q = q.Where("time < ?", time.Unix(r.Req.Query.Until, 0))
+	}
+	if r.Req.Query.Limit > 0 {
+		q = q.Limit(r.Req.Query.Limit)
+	}
+
+	q = q.Find(&entries)
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	// Entries are returned oldest first.
+	msg.Audit = make([]shared.AuditEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+
+		var targets []string
+		if e.Targets != "" {
+			targets = strings.Split(e.Targets, ",")
+		}
+
+		msg.Audit = append(msg.Audit, shared.AuditEntry{
+			Actor:    e.Actor,
+			UID:      e.UID,
+			GID:      e.GID,
+			Endpoint: e.Endpoint,
+			Secret:   e.Secret,
+			Targets:  targets,
+			Code:     e.Code,
+			Address:  e.Address,
+			Time:     e.Time.Unix(),
+		})
+	}
+
+	r.Reply(200, msg)
+}
+
+// Clients wait for changes and report their status on every poll.  These
+// requests are only audited if they fail, as they would otherwise soon fill
+// the log.  Fetching secrets is audited whenever any are sent.
+var routineEndpoints = map[string]bool{
+	"/client/watch":  true,
+	"/client/status": true,
+}
+
+// AuditRecorder wraps the response to a request, collecting the details
+// written to the audit log once the request has been handled.
+type AuditRecorder struct {
+	http.ResponseWriter
+	entry db.AuditLog
+}
+
+// NewAuditRecorder starts recording a request that is being handled now.
+func NewAuditRecorder(w http.ResponseWriter) *AuditRecorder {
+	rec := &AuditRecorder{ResponseWriter: w}
+	rec.entry.Time = time.Now()
+	return rec
+}
+
+func (a *AuditRecorder) WriteHeader(code int) {
+	if a.entry.Code == 0 {
+		a.entry.Code = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *AuditRecorder) Write(data []byte) (int, error) {
+	if a.entry.Code == 0 {
+		a.entry.Code = http.StatusOK
+	}
+	return a.ResponseWriter.Write(data)
+}
+
+// Save writes the request to the audit log, unless it was a routine client
+// request that succeeded, or a client fetching secrets it already has.  Failing to write the log does not fail the request,
+// as the response has already been sent.
+func (a *AuditRecorder) Save(cfg *shared.Config, endpoint, addr string) {
+	a.entry.Endpoint = endpoint
+	a.entry.Address = addr
+	if a.entry.Code == 0 {
+		a.entry.Code = http.StatusOK
+	}
+
+	switch {
+	case routineEndpoints[endpoint] && a.entry.Code < 400:
+		return
+	case endpoint == "/client/secrets" && a.entry.Code == http.StatusNotModified:
+		return
+	}
+
+	q := cfg.DB.Create(&a.entry)
+	if q.Error != nil {
+		cfg.Log(log.ERROR, "Unable to write audit log:", q.Error)
+	}
+}
+
+// AuditUser records who made a request.  It does nothing if the response is
+// not being audited.
+func AuditUser(w http.ResponseWriter, name string, uid, gid uint) {
+	rec, ok := w.(*AuditRecorder)
+	if !ok {
+		return
+	}
+	rec.entry.Actor = name
+	rec.entry.UID = uid
+	rec.entry.GID = gid
+}
+
+// AuditMessage records the objects a request was for.  It does nothing if
+// the response is not being audited.
+func AuditMessage(w http.ResponseWriter, msg shared.Message) {
+	rec, ok := w.(*AuditRecorder)
+	if !ok {
+		return
+	}
+	var targets []string
+	rec.entry.Secret, targets = auditTargets(msg)
+	rec.entry.Targets = strings.Join(targets, ",")
+}
+
+// auditSecrets records the names of the secrets sent in reply to a request.
+// It does nothing if the response is not being audited.
+func auditSecrets(r shared.Request, secrets []shared.Message) {
+	var sent shared.Message
+	for _, s := range secrets {
+		sent.Keys = append(sent.Keys, shared.Key{Name: s.Key.Name})
+	}
+	AuditMessage(r.Writer(), sent)
+}
+
+// auditTargets returns the names of everything a request message refers to,
+// and the secret it is for, if any.
+func auditTargets(msg shared.Message) (secret string, targets []string) {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			targets = append(targets, name)
+		}
+	}
+
+	add(msg.Key.Name)
+	add(msg.User.Name)
+	add(msg.User.Group)
+	add(msg.Auth.Name)
+	add(msg.X509.Name)
+	for _, k := range msg.Keys {
+		add(k.Name)
+	}
+
+	return msg.Key.Name, targets
+}
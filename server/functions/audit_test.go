@@ -0,0 +1,179 @@
+package functions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jfindley/skds/server/db"
+	"github.com/jfindley/skds/shared"
+)
+
+func TestAuditQuery(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	now := time.Now()
+
+	cfg.DB.Create(&db.AuditLog{Actor: "admin", UID: 1, GID: shared.SuperGID, Endpoint: "/secret/create",
+		Secret: "db", Targets: "db", Code: 204, Address: "192.0.2.1", Time: now.Add(-48 * time.Hour)})
+	cfg.DB.Create(&db.AuditLog{Actor: "admin", UID: 1, GID: shared.SuperGID, Endpoint: "/secret/assign/user",
+		Secret: "db", Targets: "db,web1", Code: 204, Address: "192.0.2.1", Time: now.Add(-time.Hour)})
+	cfg.DB.Create(&db.AuditLog{Actor: "web1", UID: 4, GID: shared.DefClientGID, Endpoint: "/client/secrets",
+		Code: 200, Address: "192.0.2.2", Time: now})
+
+	query := func(q shared.AuditQuery) []shared.AuditEntry {
+		req, resp := respRecorder()
+		req.Session = session
+		req.Req.Query = q
+
+		AuditQuery(cfg, req)
+		if resp.Code != 200 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+
+		msgs, err := shared.ReadResp(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 {
+			t.Fatal("Expected 1 message, got", len(msgs))
+		}
+		return msgs[0].Audit
+	}
+
+	entries := query(shared.AuditQuery{})
+	if len(entries) != 3 {
+		t.Fatal("Expected 3 entries, got", len(entries))
+	}
+	if entries[0].Endpoint != "/secret/create" || entries[2].Actor != "web1" {
+		t.Error("Entries not returned oldest first")
+	}
+	if len(entries[1].Targets) != 2 || entries[1].Targets[1] != "web1" || entries[1].Time != now.Add(-time.Hour).Unix() {
+		t.Error("Bad entry:", entries[1])
+	}
+
+	entries = query(shared.AuditQuery{Actor: "admin"})
+	if len(entries) != 2 {
+		t.Error("Expected 2 entries by admin, got", len(entries))
+	}
+
+	entries = query(shared.AuditQuery{Secret: "db", Since: now.Add(-24 * time.Hour).Unix()})
+	if len(entries) != 1 || entries[0].Endpoint != "/secret/assign/user" {
+		t.Error("Bad entries for secret since yesterday:", entries)
+	}
+
+	entries = query(shared.AuditQuery{Until: now.Add(-time.Minute).Unix()})
+	if len(entries) != 2 {
+		t.Error("Expected 2 entries before a minute ago, got", len(entries))
+	}
+
+	entries = query(shared.AuditQuery{Limit: 1})
+	if len(entries) != 1 || entries[0].Actor != "web1" {
+		t.Error("Limit did not return the newest entry:", entries)
+	}
+
+	req, resp := respRecorder()
+	req.Session = session
+	req.Req.Query.Since = now.Unix()
+	req.Req.Query.Until = now.Add(-time.Hour).Unix()
+
+	AuditQuery(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+}
+
+func TestAuditTargets(t *testing.T) {
+	var msg shared.Message
+	msg.Key.Name = "db"
+	msg.User.Name = "web1"
+	msg.Keys = []shared.Key{{Name: "db"}, {Name: "tls"}}
+
+	secret, targets := auditTargets(msg)
+	if secret != "db" {
+		t.Error("Expected secret db, got", secret)
+	}
+	if len(targets) != 3 || targets[0] != "db" || targets[1] != "web1" || targets[2] != "tls" {
+		t.Error("Bad targets:", targets)
+	}
+}
+
+func TestAuditRecorder(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	rec := NewAuditRecorder(httptest.NewRecorder())
+
+	AuditUser(rec, "admin", 1, shared.SuperGID)
+	msg := shared.Message{}
+	msg.Key.Name = "db"
+	AuditMessage(rec, msg)
+
+	http.Error(rec, "Unauthorized", 401)
+	rec.Save(cfg, "/secret/create", "192.0.2.1")
+
+	var entry db.AuditLog
+	q := cfg.DB.First(&entry)
+	if q.Error != nil {
+		t.Fatal(q.Error)
+	}
+	if entry.Actor != "admin" || entry.UID != 1 || entry.Secret != "db" || entry.Code != 401 ||
+		entry.Endpoint != "/secret/create" || entry.Address != "192.0.2.1" {
+		t.Error("Bad audit entry:", entry)
+	}
+
+	// Successful routine client requests are not recorded, failed ones are
+	rec = NewAuditRecorder(httptest.NewRecorder())
+	AuditUser(rec, "web1", 4, shared.DefClientGID)
+	rec.WriteHeader(304)
+	rec.Save(cfg, "/client/watch", "192.0.2.2")
+
+	rec = NewAuditRecorder(httptest.NewRecorder())
+	AuditUser(rec, "web1", 4, shared.DefClientGID)
+	rec.Write(nil)
+	rec.Save(cfg, "/client/status", "192.0.2.2")
+
+	rec = NewAuditRecorder(httptest.NewRecorder())
+	rec.WriteHeader(401)
+	rec.Save(cfg, "/client/watch", "192.0.2.2")
+
+	// Fetching secrets is recorded unless none were sent
+	rec = NewAuditRecorder(httptest.NewRecorder())
+	rec.WriteHeader(304)
+	rec.Save(cfg, "/client/secrets", "192.0.2.2")
+
+	var r shared.Request
+	rec = NewAuditRecorder(httptest.NewRecorder())
+	r.Parse(nil, rec)
+	AuditUser(rec, "web1", 4, shared.DefClientGID)
+	auditSecrets(r, []shared.Message{{Key: shared.Key{Name: "db"}}, {Key: shared.Key{Name: "tls"}}, {Key: shared.Key{Name: "db"}}})
+	r.Reply(200)
+	rec.Save(cfg, "/client/secrets", "192.0.2.2")
+
+	var count int
+	cfg.DB.Model(&db.AuditLog{}).Where("endpoint LIKE ?", "/client/%").Count(&count)
+	if count != 2 {
+		t.Error("Expected a failed watch and a secret fetch to be recorded, got", count)
+	}
+
+	entry = db.AuditLog{}
+	cfg.DB.Where("endpoint = ?", "/client/secrets").First(&entry)
+	if entry.Actor != "web1" || entry.Targets != "db,tls" {
+		t.Error("Secrets sent not recorded:", entry)
+	}
+
+	// Responses that are not audited are ignored
+	AuditUser(httptest.NewRecorder(), "admin", 1, shared.SuperGID)
+}
@@ -9,7 +9,16 @@ shared.Message messages.
 package functions
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/log"
@@ -17,6 +26,10 @@ import (
 	"github.com/jfindley/skds/shared"
 )
 
+// watchTimeout is the longest a client watch is held open.  It must be less
+// than the time clients wait for a response.
+var watchTimeout = 240 * time.Second
+
 func ClientGetSecret(cfg *shared.Config, r shared.Request) {
 	var err error
 
@@ -29,6 +42,27 @@ func ClientGetSecret(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	// A failure to record this is not a reason to withhold secrets.
+	err = user.Seen(cfg.DB, r.Addr, shared.ClientVersion(r.UserAgent))
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+	}
+
+	// Nothing has changed if neither the user nor its group have, so we can
+	// skip fetching every secret.
+	etag, err := clientETag(cfg, user)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+	r.SetETag(etag)
+
+	if r.IfNoneMatch == etag {
+		r.Reply(304)
+		return
+	}
+
 	var groupPriv crypto.Binary
 	err = groupPriv.Decode(user.GroupKey)
 	if err != nil {
@@ -40,7 +74,8 @@ func ClientGetSecret(cfg *shared.Config, r shared.Request) {
 	// We select secrets owned directly and inherited via groups separately,
 	// to make our SQL less confusing to follow.
 	rows, err := cfg.DB.Table("MasterSecrets").Select(
-		"MasterSecrets.name, MasterSecrets.secret, UserSecrets.path, UserSecrets.secret").Where(
+		`MasterSecrets.name, MasterSecrets.secret, UserSecrets.path, UserSecrets.secret,
+		UserSecrets.file_owner, UserSecrets.file_group, UserSecrets.file_mode, UserSecrets.command, UserSecrets.env, UserSecrets.sink`).Where(
 		"UserSecrets.uid = ?", r.Session.GetUID()).Joins(
 		"left join UserSecrets on MasterSecrets.id = UserSecrets.sid").Rows()
 	if err != nil {
@@ -56,28 +91,286 @@ func ClientGetSecret(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
-	rows, err = cfg.DB.Table("MasterSecrets").Select(
-		"MasterSecrets.name, MasterSecrets.secret, GroupSecrets.path, GroupSecrets.secret").Where(
-		"GroupSecrets.gid = ?", r.Session.GetGID()).Joins(
-		"left join GroupSecrets on MasterSecrets.id = GroupSecrets.sid").Rows()
+	var groupSecrets []shared.Message
+
+	// Clients registered into a group with an enrollment token cannot read
+	// its secrets until an admin has given them the group key.
+	if len(groupPriv) > 0 {
+		rows, err = cfg.DB.Table("MasterSecrets").Select(
+			`MasterSecrets.name, MasterSecrets.secret, GroupSecrets.path, GroupSecrets.secret,
+			GroupSecrets.file_owner, GroupSecrets.file_group, GroupSecrets.file_mode, GroupSecrets.command, GroupSecrets.env, GroupSecrets.sink`).Where(
+			"GroupSecrets.gid = ?", r.Session.GetGID()).Joins(
+			"left join GroupSecrets on MasterSecrets.id = GroupSecrets.sid").Rows()
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+
+		groupSecrets, err = clientSecretScanner(rows, groupPriv)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+	}
+
+	secrets := make([]shared.Message, len(userSecrets)+len(groupSecrets))
+	copy(secrets, userSecrets)
+	copy(secrets[len(userSecrets):], groupSecrets)
+
+	// While a client is rotating its keypair, it needs to know which of its
+	// keys the secrets are encrypted with.
+	var pubKey crypto.Binary
+	err = pubKey.Decode(user.PubKey)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
 		return
 	}
+	for i := range secrets {
+		secrets[i].User.Key = pubKey
+	}
+
+	if cfg.Startup.Server.WithholdExpired {
+		secrets, err = withholdExpired(cfg, user, secrets)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+	}
+
+	auditSecrets(r, secrets)
+	r.Reply(200, secrets...)
+	return
+}
+
+// clientETag returns the version of the secrets delivered to a client.
+// When expired secrets are withheld, a hash of the names of those withheld from
+// this client is included, so that it fetches its secrets again when one of
+// them expires, but not when a secret it does not have does.
+func clientETag(cfg *shared.Config, user db.Users) (etag string, err error) {
+	var group db.Groups
+	q := cfg.DB.First(&group, user.GID)
+	if q.Error != nil && !q.RecordNotFound() {
+		return "", q.Error
+	}
+
+	etag = fmt.Sprintf(`%d.%d.%d.%d`, user.Id, user.Serial, user.GID, group.Serial)
+
+	if cfg.Startup.Server.WithholdExpired {
+		withheld, err := withheldSecrets(cfg, user, time.Now())
+		if err != nil {
+			return "", err
+		}
+		if len(withheld) > 0 {
+			sum := sha256.Sum256([]byte(strings.Join(withheld, "\x00")))
+			etag += "." + hex.EncodeToString(sum[:8])
+		}
+	}
+
+	return `"` + etag + `"`, nil
+}
+
+// expiredSecrets returns the names of every secret past its expiry date.
+func expiredSecrets(cfg *shared.Config, now time.Time) (expired map[string]bool, err error) {
+	var secrets []db.MasterSecrets
+
+	q := cfg.DB.Select("name, expires").Where("expires <= ?", now).Find(&secrets)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+
+	expired = make(map[string]bool)
+	for _, secret := range secrets {
+		if secret.Expired(now) {
+			expired[secret.Name] = true
+		}
+	}
+	return expired, nil
+}
+
+// withheldSecrets returns the sorted names of the secrets assigned to user,
+// directly or via its group, that are past their expiry date.
+func withheldSecrets(cfg *shared.Config, user db.Users, now time.Time) (names []string, err error) {
+	var secrets []db.MasterSecrets
+
+	q := cfg.DB.Select("name, expires").Where("expires <= ?", now).Where(
+		"id IN (SELECT sid FROM UserSecrets WHERE uid = ?) OR id IN (SELECT sid FROM GroupSecrets WHERE gid = ?)",
+		user.Id, user.GID).Find(&secrets)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+
+	for _, secret := range secrets {
+		if secret.Expired(now) {
+			names = append(names, secret.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// withholdExpired removes secrets past their expiry date from those sent to
+// a client.  The client treats them as no longer assigned.
+func withholdExpired(cfg *shared.Config, user db.Users, secrets []shared.Message) ([]shared.Message, error) {
+	expired, err := expiredSecrets(cfg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	current := secrets[:0]
+	for _, secret := range secrets {
+		if expired[secret.Key.Name] {
+			cfg.Log(log.WARN, "Withholding expired secret", secret.Key.Name, "from client", user.Name)
+			continue
+		}
+		current = append(current, secret)
+	}
+	return current, nil
+}
+
+/*
+No input.  The If-None-Match header holds the ETag of the client's secrets.
+*/
+func ClientWatch(cfg *shared.Config, r shared.Request) {
+	// Start watching before we check for changes, so that none are missed.
+	changed, cancel := db.Watch(r.Session.GetUID(), r.Session.GetGID())
+	defer cancel()
+
+	// The session must not expire while we wait.
+	r.Session.Touch()
+
+	var user db.Users
+	q := cfg.DB.First(&user, r.Session.GetUID())
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
 
-	groupSecrets, err := clientSecretScanner(rows, groupPriv)
+	etag, err := clientETag(cfg, user)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
 		return
 	}
 
-	secrets := make([]shared.Message, len(userSecrets)+len(groupSecrets))
-	copy(secrets, userSecrets)
-	copy(secrets[len(userSecrets):], groupSecrets)
+	if r.IfNoneMatch != etag {
+		r.Reply(200)
+		return
+	}
 
-	r.Reply(200, secrets...)
+	timeout := watchTimeout
+	if r.WatchTimeout > 0 && r.WatchTimeout < timeout {
+		timeout = r.WatchTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		r.Reply(200)
+	case <-timer.C:
+		r.Reply(304)
+	case <-r.Done:
+		// There is nobody left to reply to.
+	}
+	return
+}
+
+/*
+Status => the result of applying each secret in the client's last sync
+*/
+func ClientStatus(cfg *shared.Config, r shared.Request) {
+	uid := r.Session.GetUID()
+
+	var prev []db.SecretStatus
+	q := cfg.DB.Where("uid = ?", uid).Find(&prev)
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	// Hooks only run when a file changes, so a hook result is kept until the
+	// client applies a different version of the secret.
+	hooks := make(map[string]db.SecretStatus)
+	for _, p := range prev {
+		hooks[fmt.Sprintf("%d:%s", p.SID, p.Path)] = p
+	}
+
+	tx := cfg.DB.Begin()
+	if tx.Error != nil {
+		cfg.Log(log.ERROR, tx.Error)
+		r.Reply(500)
+		return
+	}
+	var commit bool
+
+	// Avoid having to manually rollback for each error
+	defer func() {
+		if !commit {
+			tx.Rollback()
+		}
+	}()
+
+	q = tx.Where("uid = ?", uid).Delete(&db.SecretStatus{})
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	now := time.Now()
+
+	for _, s := range r.Req.Status {
+		var secret db.MasterSecrets
+
+		// The secret may have been deleted since the client fetched it.
+		q = tx.Where("name = ?", s.Name).First(&secret)
+		if q.RecordNotFound() {
+			continue
+		} else if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+
+		status := db.SecretStatus{
+			UID:    uid,
+			SID:    secret.Id,
+			Path:   s.Path,
+			Hash:   s.Hash,
+			Result: s.Result,
+			Hook:   s.Hook,
+			Error:  s.Error,
+			Time:   now,
+		}
+
+		p, ok := hooks[fmt.Sprintf("%d:%s", secret.Id, s.Path)]
+		if ok && status.Hook == "" && p.Hash == status.Hash {
+			status.Hook = p.Hook
+		}
+
+		q = tx.Create(&status)
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+	}
+
+	q = tx.Commit()
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+	commit = true
+
+	r.Reply(204)
 	return
 }
 
@@ -85,45 +378,721 @@ func ClientGetSecret(cfg *shared.Config, r shared.Request) {
 User.Name => name
 User.Password => encrypted password
 User.Key => public part of local key
+Token.Token => enrollment token (optional if registration approval is enabled)
 */
 func ClientRegister(cfg *shared.Config, r shared.Request) {
 	var user db.Users
 
+	approval := cfg.Startup.Server.Registration == shared.RegApproval
+
+	if r.Req.Token.Token == "" && !approval {
+		r.Reply(401, shared.RespMessage("An enrollment token is required to register"))
+		return
+	}
+
 	hash, err := crypto.PasswordHash(r.Req.User.Password)
 
 	user.Name = r.Req.User.Name
 	user.Admin = false
+	user.RegAddress = r.Addr
+	user.LastSeen = time.Now()
+	user.LastAddress = r.Addr
+	user.Version = shared.ClientVersion(r.UserAgent)
 
-	if !newUser(cfg, user.Name, user.Admin) {
-		r.Reply(409, shared.RespMessage("Username already exists"))
+	user.Password, err = hash.Encode()
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
 		return
 	}
 
-	user.Password, err = hash.Encode()
+	user.PubKey, err = crypto.NewBinary(r.Req.User.Key).Encode()
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
 		return
 	}
 
-	user.PubKey, err = crypto.NewBinary(r.Req.User.Key).Encode()
+	tx := cfg.DB.Begin()
+	if tx.Error != nil {
+		cfg.Log(log.ERROR, tx.Error)
+		r.Reply(500)
+		return
+	}
+	var commit bool
+
+	// Avoid having to manually rollback for each error
+	defer func() {
+		if !commit {
+			tx.Rollback()
+		}
+	}()
+
+	if !newUser(cfg, user.Name, user.Admin) {
+		r.Reply(409, shared.RespMessage("Username already exists"))
+		return
+	}
+
+	// Clients registering without a token wait for an admin to approve them.
+	if r.Req.Token.Token == "" {
+		user.Pending = true
+	} else {
+		token, code := useToken(cfg, tx, r.Req.Token.Token)
+		if code != 0 {
+			if code == 403 {
+				cfg.Log(log.WARN, "Registration of", user.Name, "from", r.Addr, "refused: invalid or expired token")
+				r.Reply(code, shared.RespMessage("Invalid or expired enrollment token"))
+			} else {
+				r.Reply(code)
+			}
+			return
+		}
+		user.GID = token.GID
+	}
+
+	q := tx.Create(&user)
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	q = tx.Commit()
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+	commit = true
+
+	switch {
+	case user.Pending:
+		cfg.Log(log.INFO, "Client", user.Name, "registered from", r.Addr, "and is awaiting approval")
+		r.Reply(202, shared.RespMessage("Registration is awaiting approval by an admin"))
+		return
+	case user.GID != 0 && user.GID != shared.DefClientGID:
+		cfg.Log(log.INFO, "Client", user.Name, "registered, pending delivery of its group key")
+	default:
+		cfg.Log(log.INFO, "Client", user.Name, "registered")
+	}
+
+	r.Reply(204)
+	return
+}
+
+// useToken checks an enrollment token is valid, and uses it up.  On failure
+// the HTTP status code to return is set.
+func useToken(cfg *shared.Config, tx *gorm.DB, value string) (token db.EnrollTokens, code int) {
+	q := tx.Where("hash = ?", crypto.TokenHash(value)).First(&token)
+	if q.RecordNotFound() || (q.Error == nil && token.Expires.Before(time.Now())) {
+		return token, 403
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		return token, 500
+	}
+
+	// Guard against the last use of a token being claimed twice at once.
+	q = tx.Exec("UPDATE EnrollTokens SET uses = uses - 1 WHERE id = ? AND uses > 0", token.Id)
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		return token, 500
+	}
+	if q.RowsAffected != 1 {
+		return token, 403
+	}
+
+	if token.Uses <= 1 {
+		q = tx.Delete(&token)
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			return token, 500
+		}
+	}
+
+	return token, 0
+}
+
+/*
+User.Group => group new clients are placed in (optional)
+Token.Uses => number of clients that may register with the token
+Token.TTL => seconds until the token expires
+*/
+func ClientTokenCreate(cfg *shared.Config, r shared.Request) {
+	var token db.EnrollTokens
+	var group db.Groups
+
+	if r.Req.Token.Uses < 1 || r.Req.Token.TTL < 1 {
+		r.Reply(400, shared.RespMessage("Uses and TTL must be positive"))
+		return
+	}
+
+	if r.Req.User.Group != "" {
+		q := cfg.DB.Where("name = ? and admin = ?", r.Req.User.Group, false).First(&group)
+		if q.RecordNotFound() {
+			r.Reply(404, shared.RespMessage("No such group"))
+			return
+		} else if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+
+		if !r.Session.CheckACL(cfg.DB, group) {
+			r.Reply(403)
+			return
+		}
+
+		token.GID = group.Id
+	}
+
+	value, err := crypto.NewToken()
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
 		return
 	}
 
-	q := cfg.DB.Create(&user)
+	token.Hash = crypto.TokenHash(value)
+	token.Uses = r.Req.Token.Uses
+	token.Expires = time.Now().Add(time.Duration(r.Req.Token.TTL) * time.Second)
+
+	q := cfg.DB.Create(&token)
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	var msg shared.Message
+	msg.Token.Token = value
+	msg.Token.Uses = token.Uses
+	msg.Token.Expires = token.Expires.Unix()
+
+	r.Reply(200, msg)
+	return
+}
+
+/*
+No input
+*/
+func ClientPendingList(cfg *shared.Config, r shared.Request) {
+	var users []db.Users
+
+	list := make([]shared.Message, 0)
+
+	q := cfg.DB.Where("pending = ? and admin = ?", true, false).Find(&users)
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	for _, user := range users {
+		var m shared.Message
+		var key crypto.Binary
+
+		err := key.Decode(user.PubKey)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+
+		m.User.Name = user.Name
+		m.User.Address = user.RegAddress
+		m.User.Key = key
+		list = append(list, m)
+	}
+
+	r.Reply(200, list...)
+	return
+}
+
+/*
+User.Name => client name
+*/
+func ClientPendingApprove(cfg *shared.Config, r shared.Request) {
+	var user db.Users
+
+	q := cfg.DB.Where("name = ? and admin = ? and pending = ?", r.Req.User.Name, false, true).First(&user)
+	if q.RecordNotFound() {
+		r.Reply(404, shared.RespMessage("No such pending client"))
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	user.Pending = false
+
+	q = cfg.DB.Save(&user)
 	if q.Error != nil {
 		cfg.Log(log.ERROR, q.Error)
 		r.Reply(500)
 		return
 	}
 
+	cfg.Log(log.INFO, "Client", user.Name, "approved by", r.Session.GetName())
+
 	r.Reply(204)
 	return
 }
 
+/*
+User.Name => client name
+*/
+func ClientPendingReject(cfg *shared.Config, r shared.Request) {
+	var user db.Users
+
+	q := cfg.DB.Where("name = ? and admin = ? and pending = ?", r.Req.User.Name, false, true).First(&user)
+	if q.RecordNotFound() {
+		r.Reply(404, shared.RespMessage("No such pending client"))
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	q = cfg.DB.Delete(&user)
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	cfg.Log(log.INFO, "Client", user.Name, "rejected by", r.Session.GetName())
+
+	r.Reply(204)
+	return
+}
+
+/*
+User.Password => new password
+User.Key => new public key
+*/
+func ClientRotate(cfg *shared.Config, r shared.Request) {
+	if r.Session.IsAdmin() {
+		r.Reply(403, shared.RespMessage("Only clients can rotate their credentials"))
+		return
+	}
+
+	if len(r.Req.User.Password) == 0 {
+		r.Reply(400, shared.RespMessage("No password provided"))
+		return
+	}
+
+	if len(r.Req.User.Key) != 32 {
+		r.Reply(400, shared.RespMessage("Invalid public key"))
+		return
+	}
+
+	var user db.Users
+	q := cfg.DB.First(&user, r.Session.GetUID())
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	hash, err := crypto.PasswordHash(r.Req.User.Password)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	user.Password, err = hash.Encode()
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	// The secrets of the client are still encrypted with its old key, so it
+	// keeps using that until an admin has re-encrypted them.
+	user.NextPubKey, err = crypto.NewBinary(r.Req.User.Key).Encode()
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	q = cfg.DB.Model(&user).UpdateColumns(map[string]interface{}{
+		"password":     user.Password,
+		"next_pub_key": user.NextPubKey,
+	})
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	cfg.Log(log.INFO, "Client", user.Name, "rotated its credentials, its secrets must now be rekeyed by an admin")
+
+	r.Reply(204)
+	return
+}
+
+/*
+User.Name => client name
+*/
+func ClientRekeyGet(cfg *shared.Config, r shared.Request) {
+	var user db.Users
+	var msg shared.Message
+
+	q := cfg.DB.Where("name = ? and admin = ?", r.Req.User.Name, false).First(&user)
+	if q.RecordNotFound() {
+		r.Reply(404, shared.RespMessage("No such client"))
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	if len(user.NextPubKey) == 0 {
+		r.Reply(404, shared.RespMessage("Client has not rotated its keypair"))
+		return
+	}
+
+	var pubKey crypto.Binary
+	err := pubKey.Decode(user.NextPubKey)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	msg.User.Name = user.Name
+	msg.User.Key = pubKey
+
+	// Clients that have not been given their group key do not need a new copy.
+	if len(user.GroupKey) > 0 {
+		var group db.Groups
+		q = cfg.DB.First(&group, user.GID)
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+		msg.User.Group = group.Name
+	}
+
+	assigned, err := userSecretNames(cfg.DB, user.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	for name := range assigned {
+		msg.Keys = append(msg.Keys, shared.Key{Name: name})
+	}
+
+	r.Reply(200, msg)
+	return
+}
+
+/*
+User.Name => client name
+User.Key => new public key of the client, as returned by /client/rekey/get
+Key.GroupPriv => group private key, encrypted with the new public key (if the client has a group key)
+Keys => Name and Key of every secret assigned directly to the client, with Key encrypted with the new public key
+*/
+func ClientRekey(cfg *shared.Config, r shared.Request) {
+	var user db.Users
+
+	tx := cfg.DB.Begin()
+	if tx.Error != nil {
+		cfg.Log(log.ERROR, tx.Error)
+		r.Reply(500)
+		return
+	}
+	var commit bool
+
+	defer func() {
+		if !commit {
+			tx.Rollback()
+		}
+	}()
+
+	q := tx.Where("name = ? and admin = ?", r.Req.User.Name, false).First(&user)
+	if q.RecordNotFound() {
+		r.Reply(404, shared.RespMessage("No such client"))
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	var pubKey crypto.Binary
+	err := pubKey.Decode(user.NextPubKey)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	if len(pubKey) == 0 {
+		r.Reply(404, shared.RespMessage("Client has not rotated its keypair"))
+		return
+	}
+
+	// The client may have rotated again since the keys were fetched.
+	if !bytes.Equal(pubKey, r.Req.User.Key) {
+		r.Reply(409, shared.RespMessage("Client has rotated its keypair again, please retry"))
+		return
+	}
+
+	if len(user.GroupKey) > 0 {
+		if len(r.Req.Key.GroupPriv) == 0 {
+			r.Reply(400, shared.RespMessage("No group key provided"))
+			return
+		}
+		user.GroupKey, err = crypto.NewBinary(r.Req.Key.GroupPriv).Encode()
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+	}
+
+	assigned, err := userSecretNames(*tx, user.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	// Every secret must be re-encrypted, or the client would be unable to
+	// read those left over.
+	keys := make(map[string][]byte)
+	for _, k := range r.Req.Keys {
+		if len(k.Key) == 0 {
+			r.Reply(400, shared.RespMessage("No key provided for "+k.Name))
+			return
+		}
+		keys[k.Name] = k.Key
+	}
+
+	if len(keys) != len(assigned) {
+		r.Reply(409, shared.RespMessage("The secrets assigned to the client have changed, please retry"))
+		return
+	}
+
+	for name, userSecret := range assigned {
+		key, ok := keys[name]
+		if !ok {
+			r.Reply(409, shared.RespMessage("The secrets assigned to the client have changed, please retry"))
+			return
+		}
+
+		enc, err := crypto.NewBinary(key).Encode()
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+
+		q = tx.Model(&userSecret).UpdateColumn("secret", enc)
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+	}
+
+	q = tx.Model(&user).UpdateColumns(map[string]interface{}{
+		"pub_key":      user.NextPubKey,
+		"next_pub_key": gorm.Expr("NULL"),
+		"group_key":    user.GroupKey,
+	})
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	err = db.UsersChanged(*tx, user.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	q = tx.Commit()
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+	commit = true
+
+	cfg.Log(log.INFO, "Client", user.Name, "rekeyed by", r.Session.GetName())
+
+	r.Reply(204)
+	return
+}
+
+// userSecretNames returns the secrets assigned directly to a user, by name.
+func userSecretNames(tx gorm.DB, uid uint) (assigned map[string]db.UserSecrets, err error) {
+	var userSecrets []db.UserSecrets
+	q := tx.Where("uid = ?", uid).Find(&userSecrets)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+
+	assigned = make(map[string]db.UserSecrets)
+	for _, us := range userSecrets {
+		var secret db.MasterSecrets
+		q = tx.First(&secret, us.SID)
+		if q.Error != nil {
+			return nil, q.Error
+		}
+		assigned[secret.Name] = us
+	}
+
+	return assigned, nil
+}
+
+/*
+User.LastSeen => only list clients not seen since this Unix time (optional)
+*/
+func ClientList(cfg *shared.Config, r shared.Request) {
+	list := make([]shared.Message, 0)
+
+	users, err := staleClients(cfg, r.Req.User.LastSeen)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	var groups []db.Groups
+	q := cfg.DB.Find(&groups)
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	groupNames := make(map[uint]string)
+	for _, g := range groups {
+		groupNames[g.Id] = g.Name
+	}
+
+	for _, user := range users {
+		var m shared.Message
+		m.User.Name = user.Name
+		m.User.Group = groupNames[user.GID]
+		m.User.Address = user.LastAddress
+		m.User.Version = user.Version
+		if !user.LastSeen.IsZero() {
+			m.User.LastSeen = user.LastSeen.Unix()
+		}
+		list = append(list, m)
+	}
+
+	r.Reply(200, list...)
+	return
+}
+
+/*
+User.LastSeen => delete clients not seen since this Unix time
+*/
+func ClientPrune(cfg *shared.Config, r shared.Request) {
+	list := make([]shared.Message, 0)
+
+	if r.Req.User.LastSeen <= 0 {
+		r.Reply(400, shared.RespMessage("No cutoff time specified"))
+		return
+	}
+
+	users, err := staleClients(cfg, r.Req.User.LastSeen)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	tx := cfg.DB.Begin()
+	if tx.Error != nil {
+		cfg.Log(log.ERROR, tx.Error)
+		r.Reply(500)
+		return
+	}
+	var commit bool
+
+	// Avoid having to manually rollback for each error
+	defer func() {
+		if !commit {
+			tx.Rollback()
+		}
+	}()
+
+	for _, user := range users {
+		q := tx.Where("uid = ?", user.Id).Delete(&db.UserSecrets{})
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+
+		q = tx.Where("uid = ?", user.Id).Delete(&db.SecretStatus{})
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+
+		q = tx.Delete(&user)
+		if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+
+		var m shared.Message
+		m.User.Name = user.Name
+		list = append(list, m)
+	}
+
+	q := tx.Commit()
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+	commit = true
+
+	cfg.Log(log.INFO, r.Session.GetName(), "deleted", len(list), "stale clients")
+
+	r.Reply(200, list...)
+	return
+}
+
+// staleClients returns all approved clients not seen since cutoff, a Unix
+// time.  If cutoff is zero, all clients are returned.
+func staleClients(cfg *shared.Config, cutoff int64) (stale []db.Users, err error) {
+	var users []db.Users
+
+	q := cfg.DB.Where("admin = ? and pending = ?", false, false).Find(&users)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+
+	for _, user := range users {
+		if cutoff == 0 || user.LastSeen.Before(time.Unix(cutoff, 0)) {
+			stale = append(stale, user)
+		}
+	}
+
+	return stale, nil
+}
+
 func clientSecretScanner(rows *sql.Rows, groupKey []byte) (msgs []shared.Message, err error) {
 	for rows.Next() {
 		var m shared.Message
@@ -132,7 +1101,8 @@ func clientSecretScanner(rows *sql.Rows, groupKey []byte) (msgs []shared.Message
 		var secret crypto.Binary
 		var key crypto.Binary
 
-		err = rows.Scan(&m.Key.Name, &encSecret, &m.Key.Path, &encKey)
+		err = rows.Scan(&m.Key.Name, &encSecret, &m.Key.Path, &encKey,
+			&m.Key.Owner, &m.Key.Group, &m.Key.Mode, &m.Key.Command, &m.Key.Env, &m.Key.Sink)
 		if err != nil {
 			return
 		}
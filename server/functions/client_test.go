@@ -1,7 +1,9 @@
 package functions
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/server/auth"
@@ -112,9 +114,51 @@ func TestClientRegister(t *testing.T) {
 	}
 	defer cfg.DB.Close()
 
+	group := db.Groups{Name: "test group"}
+	cfg.DB.Create(&group)
+
+	token := db.EnrollTokens{
+		Hash:    crypto.TokenHash("test token"),
+		GID:     group.Id,
+		Uses:    2,
+		Expires: time.Now().Add(time.Hour),
+	}
+	cfg.DB.Create(&token)
+
+	expired := db.EnrollTokens{
+		Hash:    crypto.TokenHash("expired token"),
+		Uses:    1,
+		Expires: time.Now().Add(-time.Hour),
+	}
+	cfg.DB.Create(&expired)
+
+	req.Req.User.Name = "test client"
+	req.Req.User.Password = []byte("test password")
+	req.Req.User.Key = []byte("test key")
+
+	ClientRegister(cfg, req)
+	if resp.Code != 401 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	for _, bad := range []string{"bad token", "expired token"} {
+		req, resp = respRecorder()
+		req.Req.User.Name = "test client"
+		req.Req.User.Password = []byte("test password")
+		req.Req.User.Key = []byte("test key")
+		req.Req.Token.Token = bad
+
+		ClientRegister(cfg, req)
+		if resp.Code != 403 {
+			t.Error("Bad response code:", resp.Code)
+		}
+	}
+
+	req, resp = respRecorder()
 	req.Req.User.Name = "test client"
 	req.Req.User.Password = []byte("test password")
 	req.Req.User.Key = []byte("test key")
+	req.Req.Token.Token = "test token"
 
 	ClientRegister(cfg, req)
 	if resp.Code != 204 {
@@ -125,6 +169,7 @@ func TestClientRegister(t *testing.T) {
 	req.Req.User.Name = "test client"
 	req.Req.User.Password = []byte("test password 2")
 	req.Req.User.Key = []byte("test key 2")
+	req.Req.Token.Token = "test token"
 
 	ClientRegister(cfg, req)
 	if resp.Code != 409 {
@@ -142,4 +187,734 @@ func TestClientRegister(t *testing.T) {
 	if sess.IsAdmin() {
 		t.Error("Client has admin permissions")
 	}
+
+	if user.GID != group.Id {
+		t.Error("Client not added to the token group")
+	}
+
+	// The token had two uses, and the failed registration must not have
+	// consumed one.
+	req, resp = respRecorder()
+	req.Req.User.Name = "test client 2"
+	req.Req.User.Password = []byte("test password")
+	req.Req.User.Key = []byte("test key")
+	req.Req.Token.Token = "test token"
+
+	ClientRegister(cfg, req)
+	if resp.Code != 204 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	q := cfg.DB.First(&db.EnrollTokens{}, token.Id)
+	if !q.RecordNotFound() {
+		t.Error("Used token not deleted")
+	}
+}
+
+func TestClientTokenCreate(t *testing.T) {
+	req, resp := respRecorder()
+	req.Session = session
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	ClientTokenCreate(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Token.Uses = 1
+	req.Req.Token.TTL = 60
+	req.Req.User.Group = "no such group"
+
+	ClientTokenCreate(cfg, req)
+	if resp.Code != 404 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Token.Uses = 1
+	req.Req.Token.TTL = 60
+
+	ClientTokenCreate(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err := shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := new(db.EnrollTokens)
+	q := cfg.DB.Where("hash = ?", crypto.TokenHash(msgs[0].Token.Token)).First(token)
+	if q.Error != nil {
+		t.Fatal("Token not saved:", q.Error)
+	}
+
+	if token.Uses != 1 || token.GID != 0 {
+		t.Error("Bad token:", token)
+	}
+}
+
+func TestClientPending(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	cfg.Startup.Server.Registration = shared.RegApproval
+	defer func() { cfg.Startup.Server.Registration = "" }()
+
+	for _, name := range []string{"approved client", "rejected client"} {
+		req, resp := respRecorder()
+		req.Addr = "192.0.2.1"
+		req.Req.User.Name = name
+		req.Req.User.Password = []byte("test password")
+		req.Req.User.Key = []byte("test key")
+
+		ClientRegister(cfg, req)
+		if resp.Code != 202 {
+			t.Error("Bad response code:", resp.Code)
+		}
+	}
+
+	req, resp := respRecorder()
+	req.Session = session
+
+	ClientPendingList(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err := shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatal("Expected 2 pending clients, got", len(msgs))
+	}
+	if msgs[0].User.Address != "192.0.2.1" || string(msgs[0].User.Key) != "test key" {
+		t.Error("Bad pending client:", msgs[0].User)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = "approved client"
+
+	ClientPendingApprove(cfg, req)
+	if resp.Code != 204 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = "rejected client"
+
+	ClientPendingReject(cfg, req)
+	if resp.Code != 204 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = "approved client"
+
+	ClientPendingReject(cfg, req)
+	if resp.Code != 404 {
+		t.Error("Approved client was still pending:", resp.Code)
+	}
+
+	user := new(db.Users)
+	q := cfg.DB.Where("name = ?", "approved client").First(user)
+	if q.Error != nil || user.Pending {
+		t.Error("Client not approved")
+	}
+
+	q = cfg.DB.Where("name = ?", "rejected client").First(&db.Users{})
+	if !q.RecordNotFound() {
+		t.Error("Rejected client not deleted")
+	}
+}
+
+func TestClientList(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	active := db.Users{Name: "active client", LastSeen: time.Now(), LastAddress: "192.0.2.1", Version: "0.1.0"}
+	stale := db.Users{Name: "stale client", LastSeen: time.Now().Add(-48 * time.Hour)}
+	never := db.Users{Name: "new client"}
+	cfg.DB.Create(&active)
+	cfg.DB.Create(&stale)
+	cfg.DB.Create(&never)
+
+	cfg.DB.Create(&db.UserSecrets{SID: 1, UID: stale.Id})
+
+	req, resp := respRecorder()
+	req.Session = session
+
+	ClientList(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err := shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatal("Expected 3 clients, got", len(msgs))
+	}
+	if msgs[0].User.Address != "192.0.2.1" || msgs[0].User.Version != "0.1.0" || msgs[0].User.Group != "default" {
+		t.Error("Bad client details:", msgs[0].User)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+
+	ClientPrune(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.LastSeen = time.Now().Add(-24 * time.Hour).Unix()
+
+	ClientPrune(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err = shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Error("Expected 2 stale clients, got", len(msgs))
+	}
+
+	q := cfg.DB.Where("name = ?", active.Name).First(&db.Users{})
+	if q.Error != nil {
+		t.Error("Active client deleted")
+	}
+
+	q = cfg.DB.Where("uid = ?", stale.Id).First(&db.UserSecrets{})
+	if !q.RecordNotFound() {
+		t.Error("Secrets of stale client not deleted")
+	}
+}
+
+func TestClientStatus(t *testing.T) {
+	var err error
+	var secretData crypto.Binary = []byte("secret data")
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	group := db.Groups{Name: "status group"}
+	cfg.DB.Create(&group)
+
+	current := db.Users{Name: "current client"}
+	stale := db.Users{Name: "stale client"}
+	failing := db.Users{Name: "failing client", GID: group.Id}
+	silent := db.Users{Name: "silent client", GID: group.Id}
+	for _, u := range []*db.Users{&current, &stale, &failing, &silent} {
+		cfg.DB.Create(u)
+	}
+
+	secret := db.MasterSecrets{Name: "status secret"}
+	secret.Secret, _ = secretData.Encode()
+	cfg.DB.Create(&secret)
+
+	cfg.DB.Create(&db.UserSecrets{SID: secret.Id, UID: current.Id, Path: "/etc/direct"})
+	cfg.DB.Create(&db.UserSecrets{SID: secret.Id, UID: stale.Id, Path: "/etc/direct"})
+	// Clients report the cleaned path.
+	cfg.DB.Create(&db.GroupSecrets{SID: secret.Id, GID: group.Id, Path: "/etc//group"})
+
+	hash := shared.SecretHash(secretData)
+
+	report := func(user db.Users, status ...shared.SecretStatus) {
+		req, resp := respRecorder()
+		req.Session = &auth.SessionInfo{Name: user.Name, UID: user.Id, GID: user.GID}
+		req.Req.Status = status
+
+		ClientStatus(cfg, req)
+		if resp.Code != 204 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+	}
+
+	report(current, shared.SecretStatus{Name: secret.Name, Path: "/etc/direct", Hash: hash,
+		Result: shared.StatusOK, Hook: shared.StatusOK},
+		shared.SecretStatus{Name: "no such secret", Result: shared.StatusOK})
+	// The hook does not run again when nothing has changed.
+	report(current, shared.SecretStatus{Name: secret.Name, Path: "/etc/direct", Hash: hash,
+		Result: shared.StatusOK})
+	report(stale, shared.SecretStatus{Name: secret.Name, Path: "/etc/direct", Hash: "old",
+		Result: shared.StatusOK})
+	report(failing, shared.SecretStatus{Name: secret.Name, Path: "/etc/group", Hash: hash,
+		Result: shared.StatusOK, Hook: shared.StatusFailed})
+
+	var rows []db.SecretStatus
+	cfg.DB.Where("uid = ?", current.Id).Find(&rows)
+	if len(rows) != 1 {
+		t.Fatal("Expected 1 status for client, got", len(rows))
+	}
+	if rows[0].Hook != shared.StatusOK {
+		t.Error("Hook result not kept:", rows[0].Hook)
+	}
+
+	req, resp := respRecorder()
+	req.Session = session
+	req.Req.Key.Name = secret.Name
+
+	SecretStatusList(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err := shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || len(msgs[0].Status) != 4 {
+		t.Fatal("Expected 4 clients, got", msgs)
+	}
+
+	expected := map[string]string{
+		current.Name: shared.StateCurrent,
+		stale.Name:   shared.StateStale,
+		failing.Name: shared.StateFailing,
+		silent.Name:  shared.StateStale,
+	}
+	for _, s := range msgs[0].Status {
+		if s.State != expected[s.Client] {
+			t.Error("Expected", s.Client, "to be", expected[s.Client], "got", s.State)
+		}
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "no such secret"
+
+	SecretStatusList(cfg, req)
+	if resp.Code != 404 {
+		t.Error("Bad response code:", resp.Code)
+	}
+}
+
+func TestClientGetSecretETag(t *testing.T) {
+	var err error
+	var secretData crypto.Binary = []byte("secret data")
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	group := db.Groups{Name: "etag group"}
+	cfg.DB.Create(&group)
+
+	user := db.Users{Name: "etag client", GID: group.Id}
+	cfg.DB.Create(&user)
+
+	secret := db.MasterSecrets{Name: "etag secret"}
+	secret.Secret, _ = secretData.Encode()
+	cfg.DB.Create(&secret)
+
+	cfg.DB.Create(&db.GroupSecrets{SID: secret.Id, GID: group.Id, Secret: secret.Secret, Path: "test"})
+
+	client := &auth.SessionInfo{Name: user.Name, UID: user.Id, GID: group.Id}
+
+	fetch := func(etag string) (code int, tag string) {
+		req, resp := respRecorder()
+		req.Session = client
+		req.IfNoneMatch = etag
+
+		ClientGetSecret(cfg, req)
+		return resp.Code, resp.Header().Get(shared.HdrETag)
+	}
+
+	code, etag := fetch("")
+	if code != 200 || etag == "" {
+		t.Fatal("Bad response:", code, etag)
+	}
+
+	code, tag := fetch(etag)
+	if code != 304 || tag != etag {
+		t.Error("Expected 304, got", code, tag)
+	}
+
+	err = db.SecretChanged(cfg.DB, secret.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, tag = fetch(etag)
+	if code != 200 || tag == etag {
+		t.Error("Change to group secret not detected:", code, tag)
+	}
+	etag = tag
+
+	err = db.UsersChanged(cfg.DB, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, tag = fetch(etag)
+	if code != 200 || tag == etag {
+		t.Error("Change to user not detected:", code, tag)
+	}
+}
+
+func TestClientWithholdExpired(t *testing.T) {
+	var err error
+	var secretData crypto.Binary = []byte("secret data")
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	defer func() {
+		cfg.Startup.Server.WithholdExpired = false
+	}()
+
+	user := db.Users{Name: "expiry client"}
+	cfg.DB.Create(&user)
+
+	enc, _ := secretData.Encode()
+
+	current := db.MasterSecrets{Name: "current secret", Secret: enc, Expires: time.Now().Add(time.Hour)}
+	expired := db.MasterSecrets{Name: "expired secret", Secret: enc, Expires: time.Now().Add(-time.Hour)}
+	never := db.MasterSecrets{Name: "eternal secret", Secret: enc}
+	for _, secret := range []*db.MasterSecrets{&current, &expired, &never} {
+		cfg.DB.Create(secret)
+		cfg.DB.Create(&db.UserSecrets{SID: secret.Id, UID: user.Id, Secret: enc, Path: secret.Name})
+	}
+
+	client := &auth.SessionInfo{Name: user.Name, UID: user.Id, GID: user.GID}
+
+	fetch := func() (msgs []shared.Message, etag string) {
+		req, resp := respRecorder()
+		req.Session = client
+
+		ClientGetSecret(cfg, req)
+		if resp.Code != 200 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+
+		msgs, err := shared.ReadResp(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs, resp.Header().Get(shared.HdrETag)
+	}
+
+	msgs, etag := fetch()
+	if len(msgs) != 3 {
+		t.Error("Expected 3 secrets when not withholding, got", len(msgs))
+	}
+
+	cfg.Startup.Server.WithholdExpired = true
+
+	msgs, tag := fetch()
+	if len(msgs) != 2 {
+		t.Fatal("Expected 2 secrets, got", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Key.Name == expired.Name {
+			t.Error("Expired secret sent to client")
+		}
+	}
+	if tag == etag {
+		t.Error("ETag unchanged when withholding a secret")
+	}
+
+	// Secrets expiring only change the ETag of the clients they are assigned to
+	other := db.Users{Name: "other client"}
+	cfg.DB.Create(&other)
+	cfg.DB.Create(&db.UserSecrets{SID: never.Id, UID: other.Id, Secret: enc, Path: never.Name})
+
+	otherTag, err := clientETag(cfg, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.DB.Model(&current).UpdateColumn("expires", time.Now().Add(-time.Minute))
+
+	_, newTag := fetch()
+	if newTag == tag {
+		t.Error("ETag unchanged when another assigned secret expired")
+	}
+
+	etag, err = clientETag(cfg, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != otherTag {
+		t.Error("ETag changed by a secret that is not assigned")
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	defer func(timeout time.Duration) {
+		watchTimeout = timeout
+	}(watchTimeout)
+	watchTimeout = 200 * time.Millisecond
+
+	user := db.Users{Name: "watching client"}
+	cfg.DB.Create(&user)
+
+	client := &auth.SessionInfo{Name: user.Name, UID: user.Id, GID: shared.DefClientGID}
+
+	etag, err := clientETag(cfg, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := func(etag string) int {
+		req, resp := respRecorder()
+		req.Session = client
+		req.IfNoneMatch = etag
+
+		ClientWatch(cfg, req)
+		return resp.Code
+	}
+
+	if code := watch(`"stale"`); code != 200 {
+		t.Error("Out of date client not told immediately:", code)
+	}
+
+	if code := watch(etag); code != 304 {
+		t.Error("Expected timeout, got", code)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		db.GroupsChanged(cfg.DB, shared.DefClientGID)
+	}()
+
+	start := time.Now()
+	if code := watch(etag); code != 200 {
+		t.Error("Change not reported:", code)
+	}
+	if time.Since(start) >= watchTimeout {
+		t.Error("Watch not woken by change")
+	}
+
+	etag, err = clientETag(cfg, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, resp := respRecorder()
+	req.Session = client
+	req.IfNoneMatch = etag
+	req.WatchTimeout = 20 * time.Millisecond
+
+	start = time.Now()
+	ClientWatch(cfg, req)
+	if resp.Code != 304 {
+		t.Error("Expected timeout, got", resp.Code)
+	}
+	if time.Since(start) >= watchTimeout {
+		t.Error("Client watch timeout not honoured")
+	}
+
+	done := make(chan struct{})
+	close(done)
+
+	req, resp = respRecorder()
+	req.Session = client
+	req.IfNoneMatch = etag
+	req.Done = done
+
+	start = time.Now()
+	ClientWatch(cfg, req)
+	if resp.Flushed || resp.Body.Len() != 0 || len(resp.Header()) != 0 {
+		t.Error("Replied to a client that went away")
+	}
+	if time.Since(start) >= watchTimeout {
+		t.Error("Watch not ended when the client went away")
+	}
+}
+
+func TestClientRotate(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	oldKey, _ := crypto.NewBinary([]byte("old public key")).Encode()
+	oldGroupKey, _ := crypto.NewBinary([]byte("old group key")).Encode()
+
+	group := db.Groups{Name: "rotate group"}
+	cfg.DB.Create(&group)
+
+	user := db.Users{Name: "rotate client", GID: group.Id, PubKey: oldKey, GroupKey: oldGroupKey}
+	cfg.DB.Create(&user)
+
+	direct := db.MasterSecrets{Name: "direct secret"}
+	other := db.MasterSecrets{Name: "other secret"}
+	cfg.DB.Create(&direct)
+	cfg.DB.Create(&other)
+	cfg.DB.Create(&db.UserSecrets{SID: direct.Id, UID: user.Id, Path: "/etc/direct"})
+
+	clientSession := &auth.SessionInfo{Name: user.Name, UID: user.Id, GID: user.GID}
+	newKey := make([]byte, 32)
+	newKey[0] = 1
+
+	req, resp := respRecorder()
+	req.Session = clientSession
+	req.Req.User.Password = []byte("new password")
+	req.Req.User.Key = newKey[:16]
+
+	ClientRotate(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Short key accepted:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = clientSession
+	req.Req.User.Password = []byte("new password")
+	req.Req.User.Key = newKey
+
+	ClientRotate(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	var check db.Users
+	cfg.DB.First(&check, user.Id)
+	if ok, _ := crypto.PasswordVerify([]byte("new password"), check.GetPass()); !ok {
+		t.Error("Password not changed")
+	}
+	if !bytes.Equal(check.PubKey, oldKey) {
+		t.Error("Public key changed before rekey")
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = user.Name
+
+	ClientRekeyGet(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err := shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatal("Expected 1 message, got", len(msgs))
+	}
+	if !bytes.Equal(msgs[0].User.Key, newKey) {
+		t.Error("Bad public key:", msgs[0].User.Key)
+	}
+	if msgs[0].User.Group != group.Name {
+		t.Error("Bad group:", msgs[0].User.Group)
+	}
+	if len(msgs[0].Keys) != 1 || msgs[0].Keys[0].Name != direct.Name {
+		t.Error("Bad secrets:", msgs[0].Keys)
+	}
+
+	rekey := func(pub []byte, keys ...shared.Key) int {
+		req, resp := respRecorder()
+		req.Session = session
+		req.Req.User.Name = user.Name
+		req.Req.User.Key = pub
+		req.Req.Key.GroupPriv = []byte("new group key")
+		req.Req.Keys = keys
+
+		ClientRekey(cfg, req)
+		return resp.Code
+	}
+
+	code := rekey([]byte("stale key"), shared.Key{Name: direct.Name, Key: []byte("new secret key")})
+	if code != 409 {
+		t.Error("Rekey for the wrong key accepted:", code)
+	}
+
+	code = rekey(newKey, shared.Key{Name: other.Name, Key: []byte("new secret key")})
+	if code != 409 {
+		t.Error("Rekey with the wrong secrets accepted:", code)
+	}
+
+	code = rekey(newKey, shared.Key{Name: direct.Name, Key: []byte("new secret key")})
+	if code != 204 {
+		t.Fatal("Bad response code:", code)
+	}
+
+	var rekeyed db.Users
+	cfg.DB.First(&rekeyed, user.Id)
+
+	var pub crypto.Binary
+	pub.Decode(rekeyed.PubKey)
+	if !bytes.Equal(pub, newKey) {
+		t.Error("Public key not replaced")
+	}
+	if len(rekeyed.NextPubKey) != 0 {
+		t.Error("Pending key not cleared")
+	}
+	if rekeyed.Serial != user.Serial+1 {
+		t.Error("Serial not incremented:", rekeyed.Serial)
+	}
+
+	var groupKey crypto.Binary
+	groupKey.Decode(rekeyed.GroupKey)
+	if string(groupKey) != "new group key" {
+		t.Error("Group key not replaced:", string(groupKey))
+	}
+
+	var userSecret db.UserSecrets
+	cfg.DB.Where("uid = ?", user.Id).First(&userSecret)
+
+	var secretKey crypto.Binary
+	secretKey.Decode(userSecret.Secret)
+	if string(secretKey) != "new secret key" {
+		t.Error("Secret key not replaced:", string(secretKey))
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = user.Name
+
+	ClientRekeyGet(cfg, req)
+	if resp.Code != 404 {
+		t.Error("Expected no pending rotation, got", resp.Code)
+	}
 }
@@ -205,7 +205,9 @@ func UserGroupAssign(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
-	if user.GID == group.Id {
+	// Clients registered with an enrollment token may already be members of
+	// a group, but still need to be given its key.
+	if user.GID == group.Id && (len(user.GroupKey) > 0 || r.Req.User.Group == "default") {
 		r.Reply(200, shared.RespMessage("User already member of this group"))
 		return
 	}
@@ -233,6 +235,15 @@ func UserGroupAssign(cfg *shared.Config, r shared.Request) {
 		r.Reply(500)
 		return
 	}
+
+	// The client needs to fetch the secrets of its new group.
+	err = db.UsersChanged(cfg.DB, user.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	r.Reply(204)
 	return
 }
@@ -256,4 +256,33 @@ func TestUserGroupAssign(t *testing.T) {
 	if bytes.Compare(groupKeyRaw, groupKey.Priv[:]) != 0 {
 		t.Error("Decrypted key does not match")
 	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = admin.Name
+	req.Req.User.Admin = true
+	req.Req.User.Group = group.Name
+	req.Req.Key.GroupPriv = adminPriv
+
+	UserGroupAssign(cfg, req)
+	if resp.Code != 200 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	// Users already in the group without a key, such as clients registered
+	// with an enrollment token, can be given the key.
+	admin.GroupKey = nil
+	cfg.DB.Save(admin)
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = admin.Name
+	req.Req.User.Admin = true
+	req.Req.User.Group = group.Name
+	req.Req.Key.GroupPriv = adminPriv
+
+	UserGroupAssign(cfg, req)
+	if resp.Code != 204 {
+		t.Error("Bad response code:", resp.Code)
+	}
 }
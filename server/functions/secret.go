@@ -10,6 +10,10 @@ package functions
 
 import (
 	"database/sql"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/log"
@@ -17,28 +21,53 @@ import (
 	"github.com/jfindley/skds/shared"
 )
 
+// maxFileMode is the most permissive mode a secret may be assigned.
+// Setuid, setgid and sticky bits are never allowed.
+const maxFileMode = 0777
+
+// validEnv matches the environment variable names a secret may be exported as.
+var validEnv = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validTag matches the tags a secret may be given.
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_.:=/-]+$`)
+
+// Limits on secret metadata, to fit the database columns.
+const (
+	maxDescription = 2048
+	maxTeam        = 255
+)
+
+// validSink matches the names of output sinks.  Clients may register their
+// own sinks, so the server does not know which names are valid.
+var validSink = regexp.MustCompile(`^[a-z0-9_-]*$`)
+
 /*
-No input
+Key.Name => only this secret (optional)
+Meta.Team => only secrets owned by this team (optional)
+Meta.Tags => only secrets with all of these tags (optional)
 */
 func SecretList(cfg *shared.Config, r shared.Request) {
 	list := make([]shared.Message, 0)
 
-	rows, err := cfg.DB.Table("MasterSecrets").Select("name").Rows()
+	secrets, err := secretMetadata(cfg)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
 		return
 	}
 
-	for rows.Next() {
+	for _, secret := range secrets {
+		if r.Req.Key.Name != "" && secret.Name != r.Req.Key.Name {
+			continue
+		}
+
 		var m shared.Message
-		err = rows.Scan(&m.Key.Name)
-		if err != nil {
-			cfg.Log(log.ERROR, err)
-			r.Reply(500)
-			return
+		m.Key.Name = secret.Name
+		m.Meta = secret.Meta()
+
+		if matchMeta(r.Req.Meta, m.Meta) {
+			list = append(list, m)
 		}
-		list = append(list, m)
 	}
 	r.Reply(200, list...)
 	return
@@ -47,6 +76,8 @@ func SecretList(cfg *shared.Config, r shared.Request) {
 /*
 User.Name => name
 User.Admin => admin/client user
+Meta.Team => only secrets owned by this team (optional)
+Meta.Tags => only secrets with all of these tags (optional)
 */
 func SecretListUser(cfg *shared.Config, r shared.Request) {
 	var user db.Users
@@ -63,6 +94,13 @@ func SecretListUser(cfg *shared.Config, r shared.Request) {
 
 	list := make([]shared.Message, 0)
 
+	meta, err := metaByName(cfg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	rows, err := cfg.DB.Table("MasterSecrets").Select(
 		"name, UserSecrets.path, GroupSecrets.path").Where(
 		"UserSecrets.uid = ? or GroupSecrets.gid = ?", user.Id, user.GID).Joins(
@@ -89,7 +127,10 @@ func SecretListUser(cfg *shared.Config, r shared.Request) {
 		} else if p2.Valid {
 			m.Key.Path = p2.String
 		}
-		list = append(list, m)
+		m.Meta = meta[m.Key.Name]
+		if matchMeta(r.Req.Meta, m.Meta) {
+			list = append(list, m)
+		}
 	}
 	r.Reply(200, list...)
 	return
@@ -98,6 +139,8 @@ func SecretListUser(cfg *shared.Config, r shared.Request) {
 /*
 User.Group => group name
 User.Admin => admin/client group
+Meta.Team => only secrets owned by this team (optional)
+Meta.Tags => only secrets with all of these tags (optional)
 */
 func SecretListGroup(cfg *shared.Config, r shared.Request) {
 	group := new(db.Groups)
@@ -114,6 +157,13 @@ func SecretListGroup(cfg *shared.Config, r shared.Request) {
 
 	list := make([]shared.Message, 0)
 
+	meta, err := metaByName(cfg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	rows, err := cfg.DB.Table("MasterSecrets").Select("name, GroupSecrets.path").Where(
 		"GroupSecrets.gid = ?", group.Id).Joins(
 		"left join GroupSecrets on MasterSecrets.id = GroupSecrets.sid").Rows()
@@ -135,7 +185,10 @@ func SecretListGroup(cfg *shared.Config, r shared.Request) {
 		if p.Valid {
 			m.Key.Path = p.String
 		}
-		list = append(list, m)
+		m.Meta = meta[m.Key.Name]
+		if matchMeta(r.Req.Meta, m.Meta) {
+			list = append(list, m)
+		}
 	}
 	r.Reply(200, list...)
 	return
@@ -146,6 +199,11 @@ Key.Name => name
 Key.Secret => encrypted payload
 Key.Key => unique encryption key for payload encrypted with the supergroup pubkey
 Key.UserKey => copy of above key, encrypted with admin local key
+Meta.Description => description (optional)
+Meta.Tags => tags (optional)
+Meta.Team => owning team (optional)
+Meta.Expires => Unix time the secret must be rotated by (optional)
+Meta.RotateDays => rotation period in days (optional, sets Meta.Expires if that is not given)
 */
 func SecretNew(cfg *shared.Config, r shared.Request) {
 	tx := cfg.DB.Begin()
@@ -167,6 +225,11 @@ func SecretNew(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	if reason, ok := checkMeta(r.Req.Meta); !ok {
+		r.Reply(400, shared.RespMessage(reason))
+		return
+	}
+
 	key := new(db.MasterSecrets)
 	groupKey := new(db.GroupSecrets)
 
@@ -197,6 +260,16 @@ func SecretNew(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	key.Version = 1
+	key.SetMeta(r.Req.Meta)
+	key.Created = time.Now()
+	key.CreatedBy = r.Session.GetName()
+	key.Updated = key.Created
+	key.UpdatedBy = key.CreatedBy
+	if key.Expires.IsZero() {
+		key.Rotated(key.Created)
+	}
+
 	q := tx.Create(key)
 	if q.Error != nil {
 		cfg.Log(log.ERROR, q.Error)
@@ -204,6 +277,19 @@ func SecretNew(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	q = tx.Create(&db.SecretVersions{
+		SID:     key.Id,
+		Version: key.Version,
+		Secret:  key.Secret,
+		Actor:   key.CreatedBy,
+		Time:    key.Created,
+	})
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
 	groupKey.GID = shared.SuperGID
 	groupKey.SID = key.Id // Set when the record is created
 
@@ -255,6 +341,7 @@ func SecretNew(cfg *shared.Config, r shared.Request) {
 
 /*
 Key.Name => secret name
+Key.Version => version to get (optional, defaults to the current version)
 */
 func SecretGet(cfg *shared.Config, r shared.Request) {
 	var msg shared.Message
@@ -278,8 +365,28 @@ func SecretGet(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	msg.Key.Version = master.Version
+	enc := master.Secret
+
+	if r.Req.Key.Version != 0 && r.Req.Key.Version != master.Version {
+		var version db.SecretVersions
+
+		q = cfg.DB.Where("sid = ? and version = ?", master.Id, r.Req.Key.Version).First(&version)
+		if q.RecordNotFound() {
+			r.Reply(404, shared.RespMessage("Version does not exist"))
+			return
+		} else if q.Error != nil {
+			cfg.Log(log.ERROR, q.Error)
+			r.Reply(500)
+			return
+		}
+
+		msg.Key.Version = version.Version
+		enc = version.Secret
+	}
+
 	var masterSec crypto.Binary
-	err = masterSec.Decode(master.Secret)
+	err = masterSec.Decode(enc)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
@@ -371,6 +478,13 @@ func SecretDel(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	err := db.SecretChanged(*tx, secret.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	q = tx.Where("SID = ?", secret.Id).Delete(&db.UserSecrets{})
 	if q.Error != nil && !q.RecordNotFound() {
 		cfg.Log(log.ERROR, q.Error)
@@ -385,6 +499,20 @@ func SecretDel(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	q = tx.Where("SID = ?", secret.Id).Delete(&db.SecretStatus{})
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	q = tx.Where("SID = ?", secret.Id).Delete(&db.SecretVersions{})
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
 	q = tx.Delete(secret)
 	if q.Error != nil {
 		cfg.Log(log.ERROR, q.Error)
@@ -410,7 +538,6 @@ Key.Secret => encrypted payload
 */
 func SecretUpdate(cfg *shared.Config, r shared.Request) {
 	secret := new(db.MasterSecrets)
-	var err error
 
 	q := cfg.DB.Where("name = ?", r.Req.Key.Name).First(secret)
 	if q.RecordNotFound() {
@@ -427,30 +554,295 @@ func SecretUpdate(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
-	secret.Secret, err = crypto.NewBinary(r.Req.Key.Secret).Encode()
+	enc, err := crypto.NewBinary(r.Req.Key.Secret).Encode()
 	if err != nil {
 		cfg.Log(log.ERROR, err)
 		r.Reply(500)
 		return
 	}
 
-	q = cfg.DB.Save(secret)
+	secret.Rotated(time.Now())
+
+	if !newVersion(cfg, r, secret, enc) {
+		return
+	}
+
+	r.Reply(204)
+	return
+}
+
+/*
+Key.Name => secret name
+Meta.Description => description
+Meta.Tags => tags
+Meta.Team => owning team
+Meta.Expires => Unix time the secret must be rotated by, 0 for never
+Meta.RotateDays => rotation period in days, 0 for none
+These replace the existing metadata, so must all be given.
+*/
+func SecretEdit(cfg *shared.Config, r shared.Request) {
+	var secret db.MasterSecrets
+
+	if reason, ok := checkMeta(r.Req.Meta); !ok {
+		r.Reply(400, shared.RespMessage(reason))
+		return
+	}
+
+	q := cfg.DB.Where("name = ?", r.Req.Key.Name).First(&secret)
+	if q.RecordNotFound() {
+		r.Reply(404)
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	if !r.Session.CheckACL(cfg.DB, secret) {
+		r.Reply(403)
+		return
+	}
+
+	expires := secret.Expires
+	secret.SetMeta(r.Req.Meta)
+
+	q = cfg.DB.Model(&secret).UpdateColumns(map[string]interface{}{
+		"description": secret.Description,
+		"tags":        secret.Tags,
+		"team":        secret.Team,
+		"expires":     secret.Expires,
+		"rotate_days": secret.RotateDays,
+		"updated":     time.Now(),
+		"updated_by":  r.Session.GetName(),
+	})
 	if q.Error != nil {
 		cfg.Log(log.ERROR, q.Error)
 		r.Reply(500)
 		return
 	}
 
+	// Clients need to fetch the secret again if it is no longer withheld.
+	if !expires.Equal(secret.Expires) {
+		err := db.SecretChanged(cfg.DB, secret.Id)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+	}
+
 	r.Reply(204)
 	return
 }
 
+/*
+Meta.Expires => also list secrets expiring before this Unix time (optional, defaults to only expired secrets)
+Meta.Team => only secrets owned by this team (optional)
+Meta.Tags => only secrets with all of these tags (optional)
+*/
+func SecretExpiry(cfg *shared.Config, r shared.Request) {
+	list := make([]shared.Message, 0)
+
+	now := time.Now()
+	cutoff := now
+	if r.Req.Meta.Expires > now.Unix() {
+		cutoff = time.Unix(r.Req.Meta.Expires, 0)
+	}
+
+	secrets, err := secretMetadata(cfg)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Expires.Before(secrets[j].Expires)
+	})
+
+	for _, secret := range secrets {
+		if secret.Expires.IsZero() || secret.Expires.After(cutoff) {
+			continue
+		}
+
+		var m shared.Message
+		m.Key.Name = secret.Name
+		m.Meta = secret.Meta()
+
+		if matchMeta(r.Req.Meta, m.Meta) {
+			list = append(list, m)
+		}
+	}
+
+	r.Reply(200, list...)
+	return
+}
+
+/*
+Key.Name => secret name
+*/
+func SecretHistory(cfg *shared.Config, r shared.Request) {
+	var secret db.MasterSecrets
+	var versions []db.SecretVersions
+	var msg shared.Message
+
+	q := cfg.DB.Where("name = ?", r.Req.Key.Name).First(&secret)
+	if q.RecordNotFound() {
+		r.Reply(404)
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	if !r.Session.CheckACL(cfg.DB, secret) {
+		r.Reply(403)
+		return
+	}
+
+	q = cfg.DB.Where("sid = ?", secret.Id).Order("version").Find(&versions)
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	msg.Key.Name = secret.Name
+	msg.Versions = make([]shared.SecretVersion, 0, len(versions))
+
+	for _, v := range versions {
+		var enc crypto.Binary
+		err := enc.Decode(v.Secret)
+		if err != nil {
+			cfg.Log(log.ERROR, err)
+			r.Reply(500)
+			return
+		}
+
+		msg.Versions = append(msg.Versions, shared.SecretVersion{
+			Version: v.Version,
+			Actor:   v.Actor,
+			Time:    v.Time.Unix(),
+			Hash:    shared.SecretHash(enc),
+			Current: v.Version == secret.Version,
+		})
+	}
+
+	r.Reply(200, msg)
+	return
+}
+
+/*
+Key.Name => secret name
+Key.Version => version to restore
+*/
+func SecretRollback(cfg *shared.Config, r shared.Request) {
+	var secret db.MasterSecrets
+	var version db.SecretVersions
+
+	if r.Req.Key.Version <= 0 {
+		r.Reply(400, shared.RespMessage("No version specified"))
+		return
+	}
+
+	q := cfg.DB.Where("name = ?", r.Req.Key.Name).First(&secret)
+	if q.RecordNotFound() {
+		r.Reply(404)
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	if !r.Session.CheckACL(cfg.DB, secret) {
+		r.Reply(403)
+		return
+	}
+
+	q = cfg.DB.Where("sid = ? and version = ?", secret.Id, r.Req.Key.Version).First(&version)
+	if q.RecordNotFound() {
+		r.Reply(404, shared.RespMessage("Version does not exist"))
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	if version.Version == secret.Version {
+		r.Reply(409, shared.RespMessage("Version is already current"))
+		return
+	}
+
+	// The restored data is stored as a new version, so that the rollback can
+	// itself be undone.
+	if !newVersion(cfg, r, &secret, version.Secret) {
+		return
+	}
+
+	var msg shared.Message
+	msg.Key.Name = secret.Name
+	msg.Key.Version = secret.Version
+
+	r.Reply(200, msg)
+	return
+}
+
+// newVersion stores enc as the current version of a secret, and tells the
+// clients it is assigned to.  A reply has been sent if ok is false.
+func newVersion(cfg *shared.Config, r shared.Request, secret *db.MasterSecrets, enc []byte) (ok bool) {
+	tx := cfg.DB.Begin()
+	if tx.Error != nil {
+		cfg.Log(log.ERROR, tx.Error)
+		r.Reply(500)
+		return
+	}
+	var commit bool
+
+	defer func() {
+		if !commit {
+			tx.Rollback()
+		}
+	}()
+
+	err := secret.NewVersion(*tx, enc, r.Session.GetName())
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	err = db.SecretChanged(*tx, secret.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	q := tx.Commit()
+	if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+	commit = true
+	return true
+}
+
 /*
 User.Name => user name
 User.Admin => admin/client user
 Key.Name => secret name
 Key.Key => secret key encoded with the public key of the target user
-key.Path => secret path (non-admin users only)
+key.Path => secret path (non-admin users only, unless Key.Env is set)
+Key.Owner => file owner on the client (optional)
+Key.Group => file group on the client (optional)
+Key.Mode => file permissions on the client (optional)
+Key.Command => command run on the client when the file changes (optional)
+Key.Env => environment variable the secret is exported as in exec mode (optional)
+Key.Sink => format the secret is written in on the client (optional)
 */
 func SecretAssignUser(cfg *shared.Config, r shared.Request) {
 	var err error
@@ -463,8 +855,24 @@ func SecretAssignUser(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
-	if !r.Req.User.Admin && r.Req.Key.Path == "" {
+	if !r.Req.User.Admin && r.Req.Key.Path == "" && r.Req.Key.Env == "" {
 		r.Reply(400, shared.RespMessage("No path specified"))
+		return
+	}
+
+	if r.Req.Key.Mode > maxFileMode {
+		r.Reply(400, shared.RespMessage("Invalid file mode"))
+		return
+	}
+
+	if r.Req.Key.Env != "" && !validEnv.MatchString(r.Req.Key.Env) {
+		r.Reply(400, shared.RespMessage("Invalid environment variable name"))
+		return
+	}
+
+	if !validSink.MatchString(r.Req.Key.Sink) {
+		r.Reply(400, shared.RespMessage("Invalid sink name"))
+		return
 	}
 
 	q := cfg.DB.Where("name = ? and admin = ?", r.Req.User.Name, r.Req.User.Admin).First(&user)
@@ -505,6 +913,12 @@ func SecretAssignUser(cfg *shared.Config, r shared.Request) {
 	userSecret.SID = secret.Id
 	userSecret.UID = user.Id
 	userSecret.Path = r.Req.Key.Path
+	userSecret.FileOwner = r.Req.Key.Owner
+	userSecret.FileGroup = r.Req.Key.Group
+	userSecret.FileMode = r.Req.Key.Mode
+	userSecret.Command = r.Req.Key.Command
+	userSecret.Env = r.Req.Key.Env
+	userSecret.Sink = r.Req.Key.Sink
 
 	q = cfg.DB.Create(&userSecret)
 	if q.Error != nil {
@@ -513,6 +927,13 @@ func SecretAssignUser(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	err = db.UsersChanged(cfg.DB, user.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	r.Reply(204)
 	return
 }
@@ -522,7 +943,13 @@ User.Group => group name
 User.Admin => admin/client group
 Key.Name => secret name
 Key.Key => secret key encoded with the public key of the target group
-key.Path => secret path (non-admin group only)
+key.Path => secret path (non-admin group only, unless Key.Env is set)
+Key.Owner => file owner on the client (optional)
+Key.Group => file group on the client (optional)
+Key.Mode => file permissions on the client (optional)
+Key.Command => command run on the client when the file changes (optional)
+Key.Env => environment variable the secret is exported as in exec mode (optional)
+Key.Sink => format the secret is written in on the client (optional)
 */
 func SecretAssignGroup(cfg *shared.Config, r shared.Request) {
 	var err error
@@ -535,8 +962,24 @@ func SecretAssignGroup(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
-	if !r.Req.User.Admin && r.Req.Key.Path == "" {
+	if !r.Req.User.Admin && r.Req.Key.Path == "" && r.Req.Key.Env == "" {
 		r.Reply(400, shared.RespMessage("No path specified"))
+		return
+	}
+
+	if r.Req.Key.Mode > maxFileMode {
+		r.Reply(400, shared.RespMessage("Invalid file mode"))
+		return
+	}
+
+	if r.Req.Key.Env != "" && !validEnv.MatchString(r.Req.Key.Env) {
+		r.Reply(400, shared.RespMessage("Invalid environment variable name"))
+		return
+	}
+
+	if !validSink.MatchString(r.Req.Key.Sink) {
+		r.Reply(400, shared.RespMessage("Invalid sink name"))
+		return
 	}
 
 	if r.Req.User.Admin && r.Req.User.Group == "super" {
@@ -580,6 +1023,12 @@ func SecretAssignGroup(cfg *shared.Config, r shared.Request) {
 	groupSecret.SID = secret.Id
 	groupSecret.GID = group.Id
 	groupSecret.Path = r.Req.Key.Path
+	groupSecret.FileOwner = r.Req.Key.Owner
+	groupSecret.FileGroup = r.Req.Key.Group
+	groupSecret.FileMode = r.Req.Key.Mode
+	groupSecret.Command = r.Req.Key.Command
+	groupSecret.Env = r.Req.Key.Env
+	groupSecret.Sink = r.Req.Key.Sink
 
 	q = cfg.DB.Create(&groupSecret)
 	if q.Error != nil {
@@ -588,6 +1037,13 @@ func SecretAssignGroup(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	err = db.GroupsChanged(cfg.DB, group.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	r.Reply(204)
 	return
 }
@@ -638,6 +1094,13 @@ func SecretRemoveUser(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	err := db.UsersChanged(cfg.DB, user.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	r.Reply(204)
 	return
 }
@@ -688,6 +1151,230 @@ func SecretRemoveGroup(cfg *shared.Config, r shared.Request) {
 		return
 	}
 
+	err := db.GroupsChanged(cfg.DB, group.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
 	r.Reply(204)
 	return
 }
+
+/*
+Key.Name => secret name
+*/
+func SecretStatusList(cfg *shared.Config, r shared.Request) {
+	var secret db.MasterSecrets
+
+	q := cfg.DB.Where("name = ?", r.Req.Key.Name).First(&secret)
+	if q.RecordNotFound() {
+		r.Reply(404, shared.RespMessage("Secret does not exist"))
+		return
+	} else if q.Error != nil {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	if !r.Session.CheckACL(cfg.DB, secret) {
+		r.Reply(403)
+		return
+	}
+
+	var enc crypto.Binary
+	err := enc.Decode(secret.Secret)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+	hash := shared.SecretHash(enc)
+
+	assigned, err := assignedClients(cfg, secret.Id)
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+		r.Reply(500)
+		return
+	}
+
+	var reports []db.SecretStatus
+	q = cfg.DB.Where("sid = ?", secret.Id).Find(&reports)
+	if q.Error != nil && !q.RecordNotFound() {
+		cfg.Log(log.ERROR, q.Error)
+		r.Reply(500)
+		return
+	}
+
+	type target struct {
+		uid  uint
+		path string
+	}
+
+	reported := make(map[target]db.SecretStatus)
+	for _, s := range reports {
+		reported[target{s.UID, statusPath(s.Path)}] = s
+	}
+
+	var msg shared.Message
+	msg.Status = make([]shared.SecretStatus, 0)
+
+	for _, a := range assigned {
+		status := shared.SecretStatus{
+			Name:   secret.Name,
+			Client: a.user.Name,
+			Path:   a.path,
+			State:  shared.StateStale,
+		}
+
+		s, ok := reported[target{a.user.Id, statusPath(a.path)}]
+		if ok {
+			status.Hash = s.Hash
+			status.Result = s.Result
+			status.Hook = s.Hook
+			status.Error = s.Error
+			status.Time = s.Time.Unix()
+
+			switch {
+			case s.Result == shared.StatusFailed || s.Hook == shared.StatusFailed:
+				status.State = shared.StateFailing
+			case s.Hash == hash:
+				status.State = shared.StateCurrent
+			}
+		}
+
+		msg.Status = append(msg.Status, status)
+	}
+
+	r.Reply(200, msg)
+	return
+}
+
+// statusPath returns path as clients report it.  Assignment paths are stored as
+// they were given, but clients write secrets to the cleaned path.
+func statusPath(path string) string {
+	if path == "" {
+		return path
+	}
+	return filepath.Clean(path)
+}
+
+// assignment is a client a secret is delivered to, and the path it is
+// written to.
+type assignment struct {
+	user db.Users
+	path string
+}
+
+// assignedClients returns every approved client a secret is assigned to,
+// either directly or via its group.
+func assignedClients(cfg *shared.Config, sid uint) (list []assignment, err error) {
+	var direct []db.UserSecrets
+	q := cfg.DB.Where("sid = ?", sid).Find(&direct)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+
+	for _, d := range direct {
+		var user db.Users
+		q = cfg.DB.Where("id = ? and admin = ? and pending = ?", d.UID, false, false).First(&user)
+		if q.RecordNotFound() {
+			continue
+		} else if q.Error != nil {
+			return nil, q.Error
+		}
+		list = append(list, assignment{user, d.Path})
+	}
+
+	var groups []db.GroupSecrets
+	q = cfg.DB.Where("sid = ?", sid).Find(&groups)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+
+	for _, g := range groups {
+		var users []db.Users
+		q = cfg.DB.Where("gid = ? and admin = ? and pending = ?", g.GID, false, false).Find(&users)
+		if q.Error != nil && !q.RecordNotFound() {
+			return nil, q.Error
+		}
+		for _, user := range users {
+			list = append(list, assignment{user, g.Path})
+		}
+	}
+
+	return list, nil
+}
+
+// checkMeta returns the reason metadata set by an admin is invalid, if it is.
+func checkMeta(meta shared.SecretMeta) (reason string, ok bool) {
+	if len(meta.Description) > maxDescription {
+		return "Description too long", false
+	}
+	if len(meta.Team) > maxTeam {
+		return "Team name too long", false
+	}
+	if meta.Expires < 0 || meta.RotateDays < 0 {
+		return "Invalid expiry", false
+	}
+
+	var length int
+	for _, tag := range meta.Tags {
+		if !validTag.MatchString(tag) {
+			return "Invalid tag: " + tag, false
+		}
+		length += len(tag) + 1
+	}
+	if length > maxDescription {
+		return "Too many tags", false
+	}
+
+	return "", true
+}
+
+// matchMeta returns true if a secret's metadata matches a list filter.  The
+// secret must belong to the team and have every tag in the filter.
+func matchMeta(filter, meta shared.SecretMeta) bool {
+	if filter.Team != "" && filter.Team != meta.Team {
+		return false
+	}
+
+	for _, want := range filter.Tags {
+		found := false
+		for _, tag := range meta.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// secretMetadata loads every secret without its payload.
+func secretMetadata(cfg *shared.Config) (secrets []db.MasterSecrets, err error) {
+	q := cfg.DB.Select("id, name, description, tags, team, created, created_by, updated, updated_by, expires, rotate_days").Find(&secrets)
+	if q.Error != nil && !q.RecordNotFound() {
+		return nil, q.Error
+	}
+	return secrets, nil
+}
+
+// metaByName returns the metadata of every secret, by name.
+func metaByName(cfg *shared.Config) (meta map[string]shared.SecretMeta, err error) {
+	secrets, err := secretMetadata(cfg)
+	if err != nil {
+		return
+	}
+
+	meta = make(map[string]shared.SecretMeta)
+	for _, secret := range secrets {
+		meta[secret.Name] = secret.Meta()
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/jfindley/skds/server/db"
 	"github.com/jfindley/skds/shared"
 	"testing"
+	"time"
 )
 
 func TestSecretList(t *testing.T) {
@@ -366,6 +367,10 @@ func TestSecretUpdate(t *testing.T) {
 	secret.Name = "Test secret"
 	cfg.DB.Create(secret)
 
+	user := db.Users{Name: "update client"}
+	cfg.DB.Create(&user)
+	cfg.DB.Create(&db.UserSecrets{SID: secret.Id, UID: user.Id})
+
 	req, resp = respRecorder()
 	req.Session = session
 
@@ -377,6 +382,11 @@ func TestSecretUpdate(t *testing.T) {
 		t.Error("Bad response code:", resp.Code)
 	}
 
+	cfg.DB.First(&user, user.Id)
+	if user.Serial != 1 {
+		t.Error("Serial of assigned user not incremented:", user.Serial)
+	}
+
 	cfg.DB.First(secret)
 
 	var dbSecret crypto.Binary
@@ -390,6 +400,409 @@ func TestSecretUpdate(t *testing.T) {
 	}
 }
 
+func TestSecretHistory(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	req, resp := respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "Test secret"
+	req.Req.Key.Secret = []byte("version 1")
+	req.Req.Key.Key = []byte("super key")
+	req.Req.Key.UserKey = []byte("user key")
+
+	SecretNew(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	var secret db.MasterSecrets
+	cfg.DB.Where("name = ?", "Test secret").First(&secret)
+
+	user := db.Users{Name: "history client"}
+	cfg.DB.Create(&user)
+	cfg.DB.Create(&db.UserSecrets{SID: secret.Id, UID: user.Id})
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "Test secret"
+	req.Req.Key.Secret = []byte("version 2")
+
+	SecretUpdate(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	get := func(version int) (msg shared.Message, code int) {
+		req, resp := respRecorder()
+		req.Session = session
+		req.Req.Key.Name = "Test secret"
+		req.Req.Key.Version = version
+
+		SecretGet(cfg, req)
+		if resp.Code != 200 {
+			return msg, resp.Code
+		}
+
+		msgs, err := shared.ReadResp(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs[0], resp.Code
+	}
+
+	msg, _ := get(0)
+	if string(msg.Key.Secret) != "version 2" || msg.Key.Version != 2 {
+		t.Error("Bad current version:", msg.Key.Version, string(msg.Key.Secret))
+	}
+
+	msg, _ = get(1)
+	if string(msg.Key.Secret) != "version 1" || msg.Key.Version != 1 {
+		t.Error("Bad previous version:", msg.Key.Version, string(msg.Key.Secret))
+	}
+
+	_, code := get(3)
+	if code != 404 {
+		t.Error("Bad response code:", code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "Test secret"
+
+	SecretHistory(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msgs, err := shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := msgs[0].Versions
+	if len(versions) != 2 {
+		t.Fatal("Expected 2 versions, got", len(versions))
+	}
+	if versions[0].Version != 1 || versions[0].Current || versions[0].Actor != session.Name {
+		t.Error("Bad first version:", versions[0])
+	}
+	if !versions[1].Current || versions[1].Hash != shared.SecretHash([]byte("version 2")) {
+		t.Error("Bad second version:", versions[1])
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "Test secret"
+	req.Req.Key.Version = 2
+
+	SecretRollback(cfg, req)
+	if resp.Code != 409 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "Test secret"
+	req.Req.Key.Version = 1
+
+	SecretRollback(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	msg, _ = get(0)
+	if string(msg.Key.Secret) != "version 1" || msg.Key.Version != 3 {
+		t.Error("Rollback not stored as a new version:", msg.Key.Version, string(msg.Key.Secret))
+	}
+
+	cfg.DB.First(&user, user.Id)
+	if user.Serial != 2 {
+		t.Error("Clients not told of the rollback, serial", user.Serial)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "Test secret"
+
+	SecretDel(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	var count int
+	cfg.DB.Model(&db.SecretVersions{}).Where("sid = ?", secret.Id).Count(&count)
+	if count != 0 {
+		t.Error("Versions not deleted with the secret")
+	}
+}
+
+func TestSecretMeta(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	create := func(name, team string, tags ...string) {
+		req, resp := respRecorder()
+		req.Session = session
+		req.Req.Key.Name = name
+		req.Req.Key.Secret = []byte("data")
+		req.Req.Key.Key = []byte("super key")
+		req.Req.Key.UserKey = []byte("user key")
+		req.Req.Meta.Description = "The " + name + " secret"
+		req.Req.Meta.Team = team
+		req.Req.Meta.Tags = tags
+
+		SecretNew(cfg, req)
+		if resp.Code != 204 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+	}
+
+	create("db", "payments", "prod", "db")
+	create("tls", "web", "prod")
+
+	req, resp := respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "bad"
+	req.Req.Key.Secret = []byte("data")
+	req.Req.Key.Key = []byte("super key")
+	req.Req.Key.UserKey = []byte("user key")
+	req.Req.Meta.Tags = []string{"a,b"}
+
+	SecretNew(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	list := func(filter shared.Message) []shared.Message {
+		req, resp := respRecorder()
+		req.Session = session
+		req.Req = filter
+
+		SecretList(cfg, req)
+		if resp.Code != 200 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+
+		msgs, err := shared.ReadResp(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+
+	msgs := list(shared.Message{})
+	if len(msgs) != 2 {
+		t.Fatal("Expected 2 secrets, got", len(msgs))
+	}
+	meta := msgs[0].Meta
+	if meta.Description != "The db secret" || meta.Team != "payments" || len(meta.Tags) != 2 ||
+		meta.CreatedBy != session.Name || meta.Created == 0 || meta.Updated != meta.Created {
+		t.Error("Bad metadata:", meta)
+	}
+
+	var filter shared.Message
+	filter.Meta.Tags = []string{"prod"}
+	if msgs = list(filter); len(msgs) != 2 {
+		t.Error("Expected 2 secrets tagged prod, got", len(msgs))
+	}
+
+	filter.Meta.Tags = []string{"prod", "db"}
+	if msgs = list(filter); len(msgs) != 1 || msgs[0].Key.Name != "db" {
+		t.Error("Bad secrets tagged prod and db:", msgs)
+	}
+
+	filter = shared.Message{}
+	filter.Meta.Team = "web"
+	if msgs = list(filter); len(msgs) != 1 || msgs[0].Key.Name != "tls" {
+		t.Error("Bad secrets owned by web:", msgs)
+	}
+
+	req, resp = respRecorder()
+	req.Session = unpriv
+	req.Req.Key.Name = "db"
+	req.Req.Meta.Team = "platform"
+
+	SecretEdit(cfg, req)
+	if resp.Code != 403 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "db"
+	req.Req.Meta.Description = "Payments database"
+	req.Req.Meta.Team = "platform"
+
+	SecretEdit(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	filter = shared.Message{}
+	filter.Key.Name = "db"
+	msgs = list(filter)
+	if len(msgs) != 1 {
+		t.Fatal("Expected 1 secret, got", len(msgs))
+	}
+	meta = msgs[0].Meta
+	if meta.Description != "Payments database" || meta.Team != "platform" || len(meta.Tags) != 0 ||
+		meta.UpdatedBy != session.Name || meta.CreatedBy != session.Name {
+		t.Error("Metadata not edited:", meta)
+	}
+
+	var user db.Users
+	cfg.DB.First(&user, session.UID)
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.User.Name = user.Name
+	req.Req.User.Admin = true
+	req.Req.Meta.Team = "web"
+
+	SecretListUser(cfg, req)
+	if resp.Code != 200 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+	msgs, err = shared.ReadResp(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Meta.Team != "web" {
+		t.Error("Bad secrets for user owned by web:", msgs)
+	}
+}
+
+func TestSecretExpiry(t *testing.T) {
+	var err error
+
+	err = setupDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DB.Close()
+
+	now := time.Now()
+
+	create := func(name string, meta shared.SecretMeta) {
+		req, resp := respRecorder()
+		req.Session = session
+		req.Req.Key.Name = name
+		req.Req.Key.Secret = []byte("data")
+		req.Req.Key.Key = []byte("super key")
+		req.Req.Key.UserKey = []byte("user key")
+		req.Req.Meta = meta
+
+		SecretNew(cfg, req)
+		if resp.Code != 204 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+	}
+
+	create("expired", shared.SecretMeta{Expires: now.Add(-time.Hour).Unix()})
+	create("rotated", shared.SecretMeta{RotateDays: 10})
+	create("later", shared.SecretMeta{Expires: now.AddDate(0, 0, 60).Unix()})
+	create("never", shared.SecretMeta{})
+
+	report := func(within int) []shared.Message {
+		req, resp := respRecorder()
+		req.Session = session
+		if within > 0 {
+			req.Req.Meta.Expires = now.AddDate(0, 0, within).Unix()
+		}
+
+		SecretExpiry(cfg, req)
+		if resp.Code != 200 {
+			t.Fatal("Bad response code:", resp.Code)
+		}
+
+		msgs, err := shared.ReadResp(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+
+	msgs := report(0)
+	if len(msgs) != 1 || msgs[0].Key.Name != "expired" {
+		t.Error("Bad expired secrets:", msgs)
+	}
+
+	msgs = report(30)
+	if len(msgs) != 2 || msgs[0].Key.Name != "expired" || msgs[1].Key.Name != "rotated" {
+		t.Fatal("Bad secrets expiring within 30 days:", msgs)
+	}
+	if msgs[1].Meta.RotateDays != 10 || msgs[1].Meta.Expires < now.AddDate(0, 0, 10).Unix()-60 {
+		t.Error("Expiry not set from rotation period:", msgs[1].Meta)
+	}
+
+	if msgs = report(90); len(msgs) != 3 {
+		t.Error("Expected 3 secrets expiring within 90 days, got", len(msgs))
+	}
+
+	// Rotating the secret moves its expiry date on.
+	req, resp := respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "rotated"
+	req.Req.Key.Secret = []byte("new data")
+
+	SecretUpdate(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	var secret db.MasterSecrets
+	cfg.DB.Where("name = ?", "rotated").First(&secret)
+	if secret.Expires.Before(now.AddDate(0, 0, 10).Add(-time.Minute)) {
+		t.Error("Expiry not moved on by update:", secret.Expires)
+	}
+
+	// Editing the expiry tells clients, in case the secret was withheld.
+	user := db.Users{Name: "expiry client"}
+	cfg.DB.Create(&user)
+	var expired db.MasterSecrets
+	cfg.DB.Where("name = ?", "expired").First(&expired)
+	cfg.DB.Create(&db.UserSecrets{SID: expired.Id, UID: user.Id})
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "expired"
+	req.Req.Meta.Expires = now.AddDate(1, 0, 0).Unix()
+
+	SecretEdit(cfg, req)
+	if resp.Code != 204 {
+		t.Fatal("Bad response code:", resp.Code)
+	}
+
+	if msgs = report(0); len(msgs) != 0 {
+		t.Error("Expected no expired secrets, got", msgs)
+	}
+
+	cfg.DB.First(&user, user.Id)
+	if user.Serial != 1 {
+		t.Error("Clients not told of the new expiry, serial", user.Serial)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Name = "expired"
+	req.Req.Meta.RotateDays = -1
+
+	SecretEdit(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+}
+
 func TestSecretAssignUser(t *testing.T) {
 	req, resp := respRecorder()
 	req.Session = session
@@ -463,10 +876,60 @@ func TestSecretAssignUser(t *testing.T) {
 
 	cfg.DB.Create(secret)
 
+	req.Req.Key.Mode = 04755
+
+	SecretAssignUser(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Key = []byte("test secret")
+	req.Req.User.Name = "test user"
+	req.Req.User.Admin = true
+	req.Req.Key.Name = "test secret"
+	req.Req.Key.Env = "BAD NAME"
+
+	SecretAssignUser(cfg, req)
+	if resp.Code != 400 {
+		t.Error("Bad response code:", resp.Code)
+	}
+
+	req, resp = respRecorder()
+	req.Session = session
+	req.Req.Key.Key = []byte("test secret")
+	req.Req.User.Name = "test user"
+	req.Req.User.Admin = true
+	req.Req.Key.Name = "test secret"
+	req.Req.Key.Owner = "nobody"
+	req.Req.Key.Group = "nogroup"
+	req.Req.Key.Mode = 0640
+	req.Req.Key.Command = "reload service"
+	req.Req.Key.Env = "TEST_SECRET"
+
 	SecretAssignUser(cfg, req)
 	if resp.Code != 204 {
 		t.Error("Bad response code:", resp.Code)
 	}
+
+	userSecret := new(db.UserSecrets)
+	q := cfg.DB.Where("sid = ? and uid = ?", secret.Id, user.Id).First(userSecret)
+	if q.Error != nil {
+		t.Fatal(q.Error)
+	}
+
+	if userSecret.FileOwner != "nobody" || userSecret.FileGroup != "nogroup" || userSecret.FileMode != 0640 {
+		t.Error("File attributes not saved")
+	}
+
+	if userSecret.Command != "reload service" {
+		t.Error("Command not saved")
+	}
+
+	if userSecret.Env != "TEST_SECRET" {
+		t.Error("Environment variable name not saved")
+	}
 }
 
 func TestSecretAssignGroup(t *testing.T) {
@@ -132,20 +132,20 @@ func main() {
 
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	server.Mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+	server.Mux.HandleFunc("/login", audit(cfg, "/login", func(w http.ResponseWriter, r *http.Request) {
 		login(cfg, pool, w, r)
-	})
+	}))
 
-	server.Mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+	server.Mux.HandleFunc("/logout", audit(cfg, "/logout", func(w http.ResponseWriter, r *http.Request) {
 		logout(cfg, pool, w, r)
-	})
+	}))
 
 	for url, fn := range dictionary.Dictionary {
 		// Copy references so they are not overwritten
 		f := fn
-		server.Mux.HandleFunc(url, func(w http.ResponseWriter, r *http.Request) {
+		server.Mux.HandleFunc(url, audit(cfg, url, func(w http.ResponseWriter, r *http.Request) {
 			api(cfg, pool, f, w, r)
-		})
+		}))
 	}
 
 	cfg.Log(log.INFO, "SKDS Server version", shared.Version, "started")
@@ -4,13 +4,17 @@ package main
 
 import (
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/dictionary"
 	"github.com/jfindley/skds/log"
 	"github.com/jfindley/skds/server/auth"
 	"github.com/jfindley/skds/server/db"
+	"github.com/jfindley/skds/server/functions"
 	"github.com/jfindley/skds/shared"
 )
 
@@ -38,6 +42,8 @@ func login(cfg *shared.Config, pool *auth.SessionPool, w http.ResponseWriter, r
 		return
 	}
 
+	functions.AuditUser(w, req.Req.Auth.Name, 0, 0)
+
 	user := new(db.Users)
 	err = user.Get(cfg.DB, req.Req.Auth.Name)
 	if db.NotFound(err) {
@@ -54,6 +60,18 @@ func login(cfg *shared.Config, pool *auth.SessionPool, w http.ResponseWriter, r
 		return
 	}
 
+	functions.AuditUser(w, session.Name, session.UID, session.GID)
+
+	if user.Pending {
+		req.Reply(403, shared.RespMessage("Client is awaiting approval"))
+		return
+	}
+
+	err = user.Seen(cfg.DB, remoteAddr(r), shared.ClientVersion(r.UserAgent()))
+	if err != nil {
+		cfg.Log(log.ERROR, err)
+	}
+
 	id, err := pool.Add(session)
 	if err != nil {
 		cfg.Log(log.ERROR, err)
@@ -94,6 +112,7 @@ func logout(cfg *shared.Config, pool *auth.SessionPool, w http.ResponseWriter, r
 	}
 
 	cfg.Log(log.DEBUG, pool.Pool[id].Name, "logged out")
+	functions.AuditUser(w, pool.Pool[id].Name, pool.Pool[id].UID, pool.Pool[id].GID)
 
 	pool.Delete(id)
 
@@ -101,11 +120,29 @@ func logout(cfg *shared.Config, pool *auth.SessionPool, w http.ResponseWriter, r
 	w.Write(nil)
 }
 
+// remoteAddr returns the IP address a request came from.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func api(cfg *shared.Config, pool *auth.SessionPool, job dictionary.APIFunc, w http.ResponseWriter, r *http.Request) {
 	var req shared.Request
 	var body []byte
 	var err error
 
+	req.Addr = remoteAddr(r)
+	req.UserAgent = r.UserAgent()
+	req.IfNoneMatch = r.Header.Get(shared.HdrIfNoneMatch)
+	req.Done = r.Context().Done()
+
+	if secs, convErr := strconv.Atoi(r.Header.Get(shared.HdrWatchTimeout)); convErr == nil && secs > 0 {
+		req.WatchTimeout = time.Duration(secs) * time.Second
+	}
+
 	if !job.AuthRequired {
 
 		if r.Body != nil {
@@ -123,6 +160,7 @@ func api(cfg *shared.Config, pool *auth.SessionPool, job dictionary.APIFunc, w h
 		if !req.Parse(body, w) {
 			return
 		}
+		functions.AuditMessage(w, req.Req)
 
 		job.Serverfn(cfg, req)
 
@@ -135,11 +173,13 @@ func api(cfg *shared.Config, pool *auth.SessionPool, job dictionary.APIFunc, w h
 		}
 
 		cfg.Log(log.DEBUG, pool.Pool[id].Name, "requested", r.RequestURI)
+		functions.AuditUser(w, pool.Pool[id].Name, pool.Pool[id].UID, pool.Pool[id].GID)
 
 		if !req.Parse(body, w) {
 			http.Error(w, "Unable to parse request", 400)
 			return
 		}
+		functions.AuditMessage(w, req.Req)
 
 		if job.AdminOnly && !pool.Pool[id].IsAdmin() {
 			req.Reply(403)
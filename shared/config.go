@@ -2,9 +2,11 @@ package shared
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/jinzhu/gorm"
 	"io"
+	"path/filepath"
 
 	"github.com/jfindley/skds/crypto"
 	"github.com/jfindley/skds/log"
@@ -21,6 +23,24 @@ const (
 	SuperGID = 3
 )
 
+// Client registration modes
+const (
+	// RegToken requires clients to present an enrollment token
+	RegToken = "token"
+	// RegApproval allows clients without a token to register, but they
+	// cannot log in until approved by an admin
+	RegApproval = "approval"
+)
+
+// Server selection, when clients and admins are configured with more than one
+const (
+	// FailoverOrdered tries servers in the order they are listed
+	FailoverOrdered = "ordered"
+	// FailoverRandom tries servers in an order chosen at random on startup,
+	// so that clients are spread across all servers
+	FailoverRandom = "random"
+)
+
 var DefaultAdminPass = []byte("password")
 
 // Root config object
@@ -35,27 +55,34 @@ type Config struct {
 // Runtime attributes.
 // These should never be written to disk
 type Runtime struct {
-	Log        io.Writer
-	Key        *crypto.TLSKey
-	Cert       *crypto.TLSCert
-	CAKey      *crypto.TLSKey
-	CACert     *crypto.TLSCert
-	CA         *crypto.CertPool
-	Keypair    *crypto.Key
-	ServerCert crypto.Binary
-	Password   crypto.Binary
+	Log         io.Writer
+	Key         *crypto.TLSKey
+	Cert        *crypto.TLSCert
+	CAKey       *crypto.TLSKey
+	CACert      *crypto.TLSCert
+	CA          *crypto.CertPool
+	Keypair     *crypto.Key
+	ServerCerts map[string]crypto.Binary // Pinned server certificates, by address
+	Password    crypto.Binary
+	DryRun      bool // Client only: report changes without making them
+	Offline     bool // Client only: the server cannot be reached, cached secrets are used
+	Exec        bool // Client only: secrets are passed to a command, nothing is written to disk
 }
 
 // Startup attributes.
 // These can be written to the config file safely
 type Startup struct {
-	Dir      string // Directory where certs etc are stored
-	NodeName string // Should be set to hostname for servers.
-	Address  string
+	Dir      string   // Directory where certs etc are stored
+	NodeName string   // Should be set to hostname for servers.
+	Address  string   // Address servers listen on, and clients and admins connect to
+	Servers  []string // Clients and admins only: servers to fail over between
+	Failover string   // FailoverOrdered (the default) or FailoverRandom
 	LogFile  string
 	LogLevel log.LogLevel
-	Crypto   StartupCrypto `toml:"files"`
-	DB       DBSettings    `toml:"database"`
+	Crypto   StartupCrypto  `toml:"files"`
+	DB       DBSettings     `toml:"database"`
+	Client   ClientSettings `toml:"client"`
+	Server   ServerSettings `toml:"server"`
 }
 
 type DBSettings struct {
@@ -68,6 +95,44 @@ type DBSettings struct {
 	File     string
 }
 
+// ServerSettings are only used by the server.
+type ServerSettings struct {
+	Registration    string // RegToken (the default) or RegApproval
+	WithholdExpired bool   // Do not send clients secrets that are past their expiry date
+}
+
+// ClientSettings are only used by the client.
+// All times are in seconds.
+type ClientSettings struct {
+	Interval         int               // Time between polls in daemon mode
+	Jitter           int               // Maximum random delay added to each poll
+	MaxBackoff       int               // Maximum time between polls after an error
+	HookTimeout      int               // Maximum time a hook command may run for
+	Hooks            map[string]string // Commands to run when a file changes, by path
+	AllowServerHooks bool              // Also run the commands set when secrets were assigned
+	Cleanup          string            // Unassigned files are removed, quarantined or kept
+	Quarantine       string            // Directory that quarantined files are moved to
+	Socket           string            // Path of the local agent socket, only used in daemon mode
+	AgentUsers       []string          // Local users allowed to use the agent socket
+	Token            string            // Enrollment token used to register at first run
+	MaxCacheAge      int               // Cached secrets older than this are not used.  0 is no limit
+	Watch            bool              // In daemon mode, ask the server to tell us about changes between polls
+	AllowedPaths     []string          // Directories secret files may be written in.  If empty, any path is allowed
+	Sinks            map[string]string // Format files are written in, by path, overriding the assignment
+	Templates        []Template        `toml:"templates"`
+}
+
+// Template is a local file that secrets are rendered into.
+// Source may refer to secrets by name with {{ secret "name" }}.
+type Template struct {
+	Source  string // Path to the template
+	Dest    string // Path the rendered file is written to
+	Owner   string
+	Group   string
+	Mode    string // Octal, e.g. "0640"
+	Command string // Run when Dest changes
+}
+
 type StartupCrypto struct {
 	Cert       string
 	Key        string
@@ -76,6 +141,8 @@ type StartupCrypto struct {
 	KeyPair    string
 	ServerCert string
 	Password   string // Client only.
+	Manifest   string // Client only.
+	Cache      string // Client only.
 }
 
 // Encode encodes the Startup part of a config tree in TOML format.
@@ -97,12 +164,48 @@ func (c *Config) Decode(data []byte) error {
 	c.Startup.Crypto.KeyPair = c.setPath(c.Startup.Crypto.KeyPair)
 	c.Startup.Crypto.ServerCert = c.setPath(c.Startup.Crypto.ServerCert)
 	c.Startup.Crypto.Password = c.setPath(c.Startup.Crypto.Password)
+	c.Startup.Crypto.Manifest = c.setPath(c.Startup.Crypto.Manifest)
+	c.Startup.Crypto.Cache = c.setPath(c.Startup.Crypto.Cache)
 	c.Startup.DB.File = c.setPath(c.Startup.DB.File)
 	c.Startup.LogFile = c.setPath(c.Startup.LogFile)
+	c.Startup.Client.Quarantine = c.setPath(c.Startup.Client.Quarantine)
+	c.Startup.Client.Socket = c.setPath(c.Startup.Client.Socket)
 
+	for i := range c.Startup.Client.Templates {
+		c.Startup.Client.Templates[i].Source = c.setPath(c.Startup.Client.Templates[i].Source)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Hooks and sinks are looked up by the cleaned path a secret is written to.
+	c.Startup.Client.Hooks, err = cleanPaths("hook", c.Startup.Client.Hooks)
+	if err != nil {
+		return err
+	}
+	c.Startup.Client.Sinks, err = cleanPaths("sink", c.Startup.Client.Sinks)
 	return err
 }
 
+// cleanPaths returns m with its keys cleaned.  It is an error for two keys to
+// clean to the same path.
+func cleanPaths(name string, m map[string]string) (map[string]string, error) {
+	if len(m) == 0 {
+		return m, nil
+	}
+
+	clean := make(map[string]string, len(m))
+	for path, value := range m {
+		p := filepath.Clean(path)
+		if _, ok := clean[p]; ok {
+			return nil, fmt.Errorf("More than one %s configured for %s", name, p)
+		}
+		clean[p] = value
+	}
+	return clean, nil
+}
+
 // setPath currently just prepends Config.Startup.Dir to path if path
 // is not absolute.
 func (c *Config) setPath(path string) string {
@@ -112,6 +215,15 @@ func (c *Config) setPath(path string) string {
 	return path
 }
 
+// ServerList returns the addresses of the servers that clients and admins
+// connect to.  If Servers is not set, only Address is used.
+func (c *Config) ServerList() []string {
+	if len(c.Startup.Servers) > 0 {
+		return c.Startup.Servers
+	}
+	return []string{c.Startup.Address}
+}
+
 // NewServer allocates all objects used by the server
 func (c *Config) NewServer() {
 	c.Runtime.Key = new(crypto.TLSKey)
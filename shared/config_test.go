@@ -39,3 +39,39 @@ func TestConfig(t *testing.T) {
 		t.Error("Runtime data read from file")
 	}
 }
+
+func TestConfigHooks(t *testing.T) {
+	cfg := new(Config)
+
+	err := cfg.Decode([]byte("[client.hooks]\n\"/etc/app//secret\" = \"reload app\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Startup.Client.Hooks["/etc/app/secret"] != "reload app" {
+		t.Error("Hook path not cleaned:", cfg.Startup.Client.Hooks)
+	}
+
+	cfg = new(Config)
+	err = cfg.Decode([]byte("[client.hooks]\n\"/etc/app/secret\" = \"a\"\n\"/etc/app/./secret\" = \"b\"\n"))
+	if err == nil {
+		t.Error("Duplicate hook paths accepted")
+	}
+}
+
+func TestConfigSinks(t *testing.T) {
+	cfg := new(Config)
+
+	err := cfg.Decode([]byte("[client.sinks]\n\"/etc/app/../app/env\" = \"env\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Startup.Client.Sinks["/etc/app/env"] != "env" {
+		t.Error("Sink path not cleaned:", cfg.Startup.Client.Sinks)
+	}
+
+	cfg = new(Config)
+	err = cfg.Decode([]byte("[client.sinks]\n\"/etc/app/env\" = \"env\"\n\"/etc/app//env\" = \"json\"\n"))
+	if err == nil {
+		t.Error("Duplicate sink paths accepted")
+	}
+}
@@ -1,10 +1,13 @@
 package shared
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/jinzhu/gorm"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 )
@@ -14,6 +17,13 @@ type Key struct {
 	Client    string `json:",omitempty"`
 	Admin     string `json:",omitempty"`
 	Path      string `json:",omitempty"`
+	Owner     string `json:",omitempty"` // File owner on clients
+	Group     string `json:",omitempty"` // File group on clients
+	Mode      uint32 `json:",omitempty"` // File permissions on clients
+	Command   string `json:",omitempty"` // Command run on clients when the file changes
+	Env       string `json:",omitempty"` // Environment variable name in exec mode
+	Sink      string `json:",omitempty"` // Format the secret is written in on clients
+	Version   int    `json:",omitempty"` // Version of the secret, 0 for the current one
 	Key       []byte `json:",omitempty"`
 	Secret    []byte `json:",omitempty"`
 	UserKey   []byte `json:",omitempty"`
@@ -27,6 +37,9 @@ type User struct {
 	Group    string `json:",omitempty"`
 	Password []byte `json:",omitempty"`
 	Key      []byte `json:",omitempty"`
+	Address  string `json:",omitempty"` // Address a client registered or was last seen from
+	LastSeen int64  `json:",omitempty"` // Unix time a client was last seen
+	Version  string `json:",omitempty"` // Client software version
 }
 
 type X509 struct {
@@ -39,12 +52,99 @@ type Auth struct {
 	Password []byte `json:",omitempty"`
 }
 
+// Token is a client enrollment token.
+type Token struct {
+	Token   string `json:",omitempty"`
+	Uses    int    `json:",omitempty"` // Number of clients that may register with the token
+	TTL     int    `json:",omitempty"` // Seconds until the token expires
+	Expires int64  `json:",omitempty"` // Time the token expires, as a Unix timestamp
+}
+
+// Outcomes of applying a secret or running its hooks on a client.
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// States of a secret on a client, as reported to admins.
+const (
+	StateCurrent = "current" // The client has applied the current version
+	StateStale   = "stale"   // The client has not reported the current version
+	StateFailing = "failing" // The client failed to apply the secret or run its hook
+)
+
+// SecretStatus is the result of applying a secret on a client.
+type SecretStatus struct {
+	Name   string `json:",omitempty"`
+	Path   string `json:",omitempty"`
+	Hash   string `json:",omitempty"` // SecretHash of the encrypted secret
+	Result string `json:",omitempty"` // StatusOK or StatusFailed
+	Hook   string `json:",omitempty"` // StatusOK, StatusFailed, or empty if no hook ran
+	Error  string `json:",omitempty"`
+	Client string `json:",omitempty"` // Only set in responses to admins
+	State  string `json:",omitempty"` // Only set in responses to admins
+	Time   int64  `json:",omitempty"` // Unix time the status was reported
+}
+
+// SecretMeta is descriptive information about a secret.  Unlike the secret
+// itself, it is stored in plain text on the server.
+type SecretMeta struct {
+	Description string   `json:",omitempty"`
+	Tags        []string `json:",omitempty"`
+	Team        string   `json:",omitempty"` // Team that owns the secret
+	Created     int64    `json:",omitempty"` // Unix time
+	CreatedBy   string   `json:",omitempty"`
+	Updated     int64    `json:",omitempty"` // Unix time the secret or its metadata last changed
+	UpdatedBy   string   `json:",omitempty"`
+	Expires     int64    `json:",omitempty"` // Unix time the secret must be rotated by
+	RotateDays  int      `json:",omitempty"` // Rotation period.  Updating the secret moves Expires on by this
+}
+
+// SecretVersion describes a stored version of a secret.
+type SecretVersion struct {
+	Version int    `json:",omitempty"`
+	Actor   string `json:",omitempty"` // Admin that stored the version
+	Time    int64  `json:",omitempty"` // Unix time the version was stored
+	Hash    string `json:",omitempty"` // SecretHash of the encrypted secret
+	Current bool   `json:",omitempty"`
+}
+
+// AuditEntry is a record of an API request, as shown to super users.
+type AuditEntry struct {
+	Actor    string   `json:",omitempty"` // Name of the user that made the request
+	UID      uint     `json:",omitempty"`
+	GID      uint     `json:",omitempty"`
+	Endpoint string   `json:",omitempty"`
+	Secret   string   `json:",omitempty"` // Secret the request was for
+	Targets  []string `json:",omitempty"` // Names of all users, groups and secrets the request was for
+	Code     int      `json:",omitempty"` // HTTP status of the response
+	Address  string   `json:",omitempty"`
+	Time     int64    `json:",omitempty"` // Unix time of the request
+}
+
+// AuditQuery selects entries from the audit log.  Empty fields match every
+// entry.
+type AuditQuery struct {
+	Actor  string `json:",omitempty"`
+	Secret string `json:",omitempty"`
+	Since  int64  `json:",omitempty"` // Unix time of the earliest entry
+	Until  int64  `json:",omitempty"` // Unix time entries must be before
+	Limit  int    `json:",omitempty"` // Maximum number of entries, newest first
+}
+
 type Message struct {
-	Key      Key    `json:",omitempty"`
-	User     User   `json:",omitempty"`
-	X509     X509   `json:"x509,omitempty"`
-	Auth     Auth   `json:",omitempty"`
-	Response string `json:",omitempty"`
+	Key      Key             `json:",omitempty"`
+	User     User            `json:",omitempty"`
+	X509     X509            `json:"x509,omitempty"`
+	Auth     Auth            `json:",omitempty"`
+	Token    Token           `json:",omitempty"`
+	Status   []SecretStatus  `json:",omitempty"`
+	Keys     []Key           `json:",omitempty"` // Used where a request covers several secrets at once
+	Audit    []AuditEntry    `json:",omitempty"`
+	Versions []SecretVersion `json:",omitempty"`
+	Meta     SecretMeta      `json:",omitempty"` // Also used to filter secret lists
+	Query    AuditQuery      `json:",omitempty"`
+	Response string          `json:",omitempty"`
 }
 
 // ACL returns true if the UID/GID pair should be allowed access to the subject.
@@ -59,13 +159,20 @@ type ClientSession interface {
 	IsAdmin() bool
 	IsSuper() bool
 	NextKey() crypto.Binary
+	Touch()
 	CheckACL(gorm.DB, ...ACL) bool
 }
 
 type Request struct {
-	Req     Message
-	Session ClientSession
-	writer  http.ResponseWriter
+	Req         Message
+	Session     ClientSession
+	Addr        string // Remote IP address
+	UserAgent   string
+	IfNoneMatch string // Version of the response the client already has
+	// Longest the client will wait for a watch to return, 0 if it did not say
+	WatchTimeout time.Duration
+	Done         <-chan struct{} // Closed if the client goes away
+	writer       http.ResponseWriter
 }
 
 // New reads the request body and headers from the client request, and sets the
@@ -80,10 +187,21 @@ func (r *Request) Parse(body []byte, resp http.ResponseWriter) bool {
 	return true
 }
 
+// Writer returns the response writer of the request.
+func (r *Request) Writer() http.ResponseWriter {
+	return r.writer
+}
+
 func (r *Request) SetSessionID(id int64) {
 	r.writer.Header().Set(HdrSession, strconv.FormatInt(id, 10))
 }
 
+// SetETag sets the version of the response, which the client may send back
+// to find out if anything has changed.
+func (r *Request) SetETag(tag string) {
+	r.writer.Header().Set(HdrETag, tag)
+}
+
 // Reply sends a response to a request.  We never return anything, as there's
 // no useful handling the server can do if our response fails.
 func (r *Request) Reply(code int, messages ...Message) {
@@ -115,6 +233,14 @@ func (r *Request) Reply(code int, messages ...Message) {
 	r.writer.Write(body)
 }
 
+// SecretHash identifies a version of a secret.  It is computed from the
+// encrypted secret, so that the server can compare versions reported by
+// clients without being able to read them.
+func SecretHash(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
+
 // RespMessage creates a message with a given response string.
 func RespMessage(r string) (m Message) {
 	m.Response = r
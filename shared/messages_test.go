@@ -34,6 +34,8 @@ func (s *mockSession) NextKey() crypto.Binary {
 	return []byte("123456")
 }
 
+func (s *mockSession) Touch() {}
+
 func (s *mockSession) GetName() string {
 	return "admin"
 }
@@ -2,16 +2,21 @@ package shared
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
+	"github.com/jfindley/skds/log"
 )
 
 var maxLen = 200
@@ -26,8 +31,26 @@ const (
 	HdrMAC = "X-AUTH-MAC"
 	// Session key header
 	HdrKey = "X-AUTH-KEY"
+	// Version of a response, and the version a client already has
+	HdrETag        = "ETag"
+	HdrIfNoneMatch = "If-None-Match"
+	// Longest a client will wait for a watch to return, in seconds
+	HdrWatchTimeout = "X-Watch-Timeout"
 )
 
+// SessionExpiry is the idle time after which the server expires a session.
+// Clients treat their session as expired slightly before this, to avoid racing
+// the server.
+const SessionExpiry = 1800 * time.Second
+
+const expiryMargin = 60 * time.Second
+
+// uaPrefix is prepended to our version in the User-Agent header.
+const uaPrefix = "SKDS version "
+
+// Foreign user agents are truncated to this length when stored.
+const maxUALen = 64
+
 var errorCodes = map[int]string{
 	400: "Bad request",
 	401: "Authentication failed",
@@ -37,6 +60,37 @@ var errorCodes = map[int]string{
 	500: "Internal server error",
 }
 
+// ErrNotModified is returned by GetChanged when the server has nothing new.
+var ErrNotModified = errors.New("Not modified")
+
+// ErrUnauthorized is returned when the server rejects our session.  The local
+// session is reset when this happens, and a new login is required.
+var ErrUnauthorized = errors.New(errorCodes[401])
+
+// StatusError is returned when the server responds to a request with an
+// error, so that callers can tell what it was.
+type StatusError struct {
+	Code     int
+	Response string // The message sent by the server, if any
+}
+
+func (e StatusError) Error() string {
+	if e.Response != "" {
+		return fmt.Sprintf("%s: %s", errorCodes[e.Code], e.Response)
+	}
+	return errorCodes[e.Code]
+}
+
+// IsRejected returns true if err means the server refused a request, rather
+// than failing to handle it.
+func IsRejected(err error) bool {
+	var s StatusError
+	if errors.As(err, &s) {
+		return s.Code >= 400 && s.Code < 500
+	}
+	return err == ErrUnauthorized
+}
+
 type Session struct {
 	Password   []byte
 	ServerCert []byte
@@ -44,9 +98,13 @@ type Session struct {
 
 	sessionID  int64
 	sessionKey crypto.Binary
+	lastUsed   time.Time
 	client     *http.Client
 	tls        *tls.Config
-	serverPath string
+	servers    []string // Server addresses, in the order they are tried
+	current    int      // Index of the server in use
+	connected  bool
+	logger     func(log.LogLevel, ...interface{})
 }
 
 func (s *Session) New(cfg *Config) error {
@@ -59,39 +117,88 @@ func (s *Session) New(cfg *Config) error {
 	}
 
 	s.client = &http.Client{Transport: tr}
-	// We use the http scheme as we handle the TLS seperately.
-	s.serverPath = "http://" + cfg.Startup.Address
+	s.logger = cfg.Log
+
+	s.servers = append([]string(nil), cfg.ServerList()...)
+	if cfg.Startup.Failover == FailoverRandom {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i, j := range r.Perm(len(s.servers)) {
+			s.servers[i], s.servers[j] = s.servers[j], s.servers[i]
+		}
+	}
+	s.current = 0
+	s.connected = false
 
 	return nil
 }
 
 func (s *Session) Get(url string) (resp []Message, err error) {
-	request, err := http.NewRequest("GET", s.fmtURL(url), nil)
+	resp, _, err = s.get(context.Background(), url, nil)
+	return
+}
+
+// GetChanged is like Get, but only fetches url if the server's version of it
+// differs from etag.  If it does not, ErrNotModified is returned.  The version
+// of the response is returned in tag.
+func (s *Session) GetChanged(url, etag string) (resp []Message, tag string, err error) {
+	return s.getChanged(context.Background(), url, etag, make(http.Header))
+}
+
+// Watch is GetChanged for a request that the server holds open until url
+// changes.  The server is asked to reply within timeout, and the request is
+// given up on if ctx is cancelled first.  The server rotates our session key
+// when it replies, so the session is reset if the request is given up on, and
+// a new login is required.
+func (s *Session) Watch(ctx context.Context, url, etag string, timeout time.Duration) (resp []Message, tag string, err error) {
+	header := make(http.Header)
+	header.Set(HdrWatchTimeout, strconv.Itoa(int(timeout/time.Second)))
+	return s.getChanged(ctx, url, etag, header)
+}
+
+func (s *Session) getChanged(ctx context.Context, url, etag string, header http.Header) (resp []Message, tag string, err error) {
+	if etag != "" {
+		header.Set(HdrIfNoneMatch, etag)
+	}
+
+	resp, header, err = s.get(ctx, url, header)
 	if err != nil {
 		return
 	}
 
-	s.setHeaders(request, nil)
+	return resp, header.Get(HdrETag), nil
+}
 
-	r, err := s.client.Do(request)
+func (s *Session) get(ctx context.Context, url string, header http.Header) (resp []Message, respHeader http.Header, err error) {
+	r, err := s.do(ctx, "GET", url, nil, header)
 	if err != nil {
 		return
 	}
 
+	if r.StatusCode == http.StatusUnauthorized && s.sessionID != 0 {
+		s.reset()
+		return nil, nil, ErrUnauthorized
+	}
+
 	err = s.nextKey(r)
 	if err != nil {
 		return
 	}
+	respHeader = r.Header
+
+	if r.StatusCode == http.StatusNotModified {
+		r.Body.Close()
+		return nil, respHeader, ErrNotModified
+	}
 
 	resp, err = ReadResp(r.Body)
 
 	if r.StatusCode > 299 || r.StatusCode < 200 {
-		if len(resp) > 0 && resp[0].Response != "" {
-			err = fmt.Errorf("%s: %s", errorCodes[r.StatusCode], resp[0].Response)
-		} else {
-			err = errors.New(errorCodes[r.StatusCode])
+		status := StatusError{Code: r.StatusCode}
+		if len(resp) > 0 {
+			status.Response = resp[0].Response
 		}
-		return resp, err
+		err = status
+		return resp, respHeader, err
 	}
 
 	return
@@ -104,16 +211,14 @@ func (s *Session) Post(url string, msg Message) (resp []Message, err error) {
 		return
 	}
 
-	request, err := http.NewRequest("POST", s.fmtURL(url), bytes.NewReader(data))
+	r, err := s.do(context.Background(), "POST", url, data, nil)
 	if err != nil {
 		return
 	}
 
-	s.setHeaders(request, data)
-
-	r, err := s.client.Do(request)
-	if err != nil {
-		return
+	if r.StatusCode == http.StatusUnauthorized && s.sessionID != 0 {
+		s.reset()
+		return nil, ErrUnauthorized
 	}
 
 	err = s.nextKey(r)
@@ -124,11 +229,11 @@ func (s *Session) Post(url string, msg Message) (resp []Message, err error) {
 	resp, err = ReadResp(r.Body)
 
 	if r.StatusCode > 299 || r.StatusCode < 200 {
-		if len(resp) > 0 && resp[0].Response != "" {
-			err = fmt.Errorf("%s: %s", errorCodes[r.StatusCode], resp[0].Response)
-		} else {
-			err = errors.New(errorCodes[r.StatusCode])
+		status := StatusError{Code: r.StatusCode}
+		if len(resp) > 0 {
+			status.Response = resp[0].Response
 		}
+		err = status
 		return resp, err
 	}
 
@@ -145,20 +250,13 @@ func (s *Session) Login(cfg *Config) (err error) {
 		return
 	}
 
-	request, err := http.NewRequest("POST", s.fmtURL("/login"), bytes.NewReader(data))
-	if err != nil {
-		return
-	}
-
-	s.setHeaders(request, data)
-
-	r, err := s.client.Do(request)
+	r, err := s.do(context.Background(), "POST", "/login", data, nil)
 	if err != nil {
 		return
 	}
 
 	if r.StatusCode > 299 || r.StatusCode < 200 {
-		return errors.New(errorCodes[r.StatusCode])
+		return StatusError{Code: r.StatusCode}
 	}
 	s.sessionID, err = strconv.ParseInt(r.Header.Get(HdrSession), 10, 64)
 	if err != nil {
@@ -180,6 +278,7 @@ func (s *Session) Login(cfg *Config) (err error) {
 		s.GroupKey = msgs[0].User.Key
 	}
 
+	s.lastUsed = time.Now()
 	return
 }
 
@@ -187,27 +286,96 @@ func (s *Session) Logout(cfg *Config) (err error) {
 	if s.client == nil {
 		return
 	}
-	request, err := http.NewRequest("GET", s.fmtURL("/logout"), nil)
-	if err != nil {
-		return
-	}
+	// Whatever the server says, this session is no longer usable.
+	defer s.reset()
 
-	s.setHeaders(request, nil)
-
-	r, err := s.client.Do(request)
+	r, err := s.do(context.Background(), "GET", "/logout", nil, nil)
 	if err != nil {
 		return
 	}
 
 	if r.StatusCode > 299 || r.StatusCode < 200 {
-		return errors.New(errorCodes[r.StatusCode])
+		return StatusError{Code: r.StatusCode}
 	}
 
 	return
 }
 
+// Active returns true if we are logged in, and the server should not yet have
+// expired our session.
+func (s *Session) Active() bool {
+	if s.sessionID == 0 {
+		return false
+	}
+	return time.Since(s.lastUsed) < SessionExpiry-expiryMargin
+}
+
+func (s *Session) reset() {
+	s.sessionID = 0
+	s.sessionKey = nil
+}
+
+// do sends a request to the server in use.  If we are unable to connect to
+// it, or it fails the TLS handshake or certificate check, the other servers
+// are tried in turn, and the first that works is used from then on.
+// Sessions are not shared between servers, so after failing over the next
+// authenticated request fails with ErrUnauthorized and we log in again.
+func (s *Session) do(ctx context.Context, method, url string, data []byte, header http.Header) (r *http.Response, err error) {
+	if len(s.servers) == 0 {
+		return nil, errors.New("No server configured")
+	}
+
+	for i := range s.servers {
+		n := (s.current + i) % len(s.servers)
+		addr := s.servers[n]
+
+		var body io.Reader
+		if data != nil {
+			body = bytes.NewReader(data)
+		}
+
+		// We use the http scheme as we handle the TLS seperately.
+		var request *http.Request
+		request, err = http.NewRequestWithContext(ctx, method, "http://"+addr+url, body)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			request.Header[k] = v
+		}
+		s.setHeaders(request, data)
+
+		r, err = s.client.Do(request)
+		if err == nil {
+			if n != s.current || !s.connected {
+				s.logger(log.INFO, "Connected to server", addr)
+			}
+			s.current = n
+			s.connected = true
+			return r, nil
+		}
+
+		if ctx.Err() != nil {
+			s.reset()
+			return nil, err
+		}
+
+		if !IsConnError(err) {
+			return nil, err
+		}
+
+		s.logger(log.WARN, "Unable to connect to server", addr+":", err)
+	}
+
+	if len(s.servers) > 1 {
+		err = fmt.Errorf("Unable to connect to any server, last error: %w", err)
+	}
+	return nil, err
+}
+
 func (s *Session) setHeaders(request *http.Request, data []byte) {
-	request.Header.Add(hdrUA, "SKDS version "+Version)
+	request.Header.Add(hdrUA, uaPrefix+Version)
 	if data != nil {
 		request.Header.Add(hdrEnc, "application/json")
 		request.ContentLength = int64(len(data))
@@ -238,11 +406,20 @@ func (s *Session) nextKey(r *http.Response) (err error) {
 		return errors.New("Session key not rotated")
 	}
 	s.sessionKey = newKey
+	s.lastUsed = time.Now()
 	return
 }
 
-func (s *Session) fmtURL(u string) string {
-	return s.serverPath + u
+// ClientVersion extracts the version from the User-Agent header sent by an
+// SKDS client.  Other user agents are returned as-is, up to maxUALen characters.
+func ClientVersion(ua string) string {
+	if strings.HasPrefix(ua, uaPrefix) {
+		return strings.TrimPrefix(ua, uaPrefix)
+	}
+	if len(ua) > maxUALen {
+		return ua[:maxUALen]
+	}
+	return ua
 }
 
 // ReadResp parses a message array from an io.Reader.
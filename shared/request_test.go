@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jfindley/skds/crypto"
 )
@@ -47,7 +49,7 @@ func TestGet(t *testing.T) {
 	defer ts.Close()
 
 	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
-	cfg.Runtime.ServerCert = ts.TLS.Certificates[0].Certificate[0]
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{cfg.Startup.Address: ts.TLS.Certificates[0].Certificate[0]}
 
 	err = cfg.Session.New(cfg)
 	if err != nil {
@@ -114,7 +116,7 @@ func TestPost(t *testing.T) {
 	defer ts.Close()
 
 	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
-	cfg.Runtime.ServerCert = ts.TLS.Certificates[0].Certificate[0]
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{cfg.Startup.Address: ts.TLS.Certificates[0].Certificate[0]}
 
 	err = cfg.Session.New(cfg)
 	if err != nil {
@@ -177,7 +179,7 @@ func TestLogin(t *testing.T) {
 	defer ts.Close()
 
 	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
-	cfg.Runtime.ServerCert = ts.TLS.Certificates[0].Certificate[0]
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{cfg.Startup.Address: ts.TLS.Certificates[0].Certificate[0]}
 
 	err := cfg.Session.New(cfg)
 	if err != nil {
@@ -196,3 +198,147 @@ func TestLogin(t *testing.T) {
 		t.Error("SessionKey not set")
 	}
 }
+
+func TestSessionExpired(t *testing.T) {
+	cfg = new(Config)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{cfg.Startup.Address: ts.TLS.Certificates[0].Certificate[0]}
+
+	err := cfg.Session.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Session.sessionID = 1
+	cfg.Session.sessionKey = []byte("qwerty1234")
+	cfg.Session.lastUsed = time.Now()
+
+	if !cfg.Session.Active() {
+		t.Fatal("Session should be active")
+	}
+
+	_, err = cfg.Session.Get("/")
+	if err != ErrUnauthorized {
+		t.Error("Expected ErrUnauthorized, got", err)
+	}
+
+	if cfg.Session.Active() {
+		t.Error("Session still active after being rejected")
+	}
+
+	cfg.Session.sessionID = 1
+	cfg.Session.lastUsed = time.Now().Add(-SessionExpiry)
+
+	if cfg.Session.Active() {
+		t.Error("Idle session still active")
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	if v := ClientVersion(uaPrefix + Version); v != Version {
+		t.Error("Bad version:", v)
+	}
+
+	if v := ClientVersion(strings.Repeat("x", 100)); len(v) != maxUALen {
+		t.Error("Foreign user agent not truncated")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	cfg = new(Config)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+
+	bad := httptest.NewTLSServer(handler)
+	defer bad.Close()
+	good := httptest.NewTLSServer(handler)
+	defer good.Close()
+
+	// Nothing is listening on this address once the listener is closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	badAddr := strings.TrimPrefix(bad.URL, "https://")
+	goodAddr := strings.TrimPrefix(good.URL, "https://")
+
+	cfg.Startup.Servers = []string{dead, badAddr, goodAddr}
+	cfg.Startup.Crypto.ServerCert = "test"
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{
+		badAddr:  []byte("not the server certificate"),
+		goodAddr: good.TLS.Certificates[0].Certificate[0],
+	}
+
+	err = cfg.Session.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cfg.Session.Get("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Session.servers[cfg.Session.current] != goodAddr {
+		t.Error("Wrong server in use:", cfg.Session.servers[cfg.Session.current])
+	}
+
+	cfg.Startup.Servers = []string{dead, badAddr}
+
+	err = cfg.Session.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cfg.Session.Get("/")
+	if err == nil {
+		t.Error("Request succeeded with no working servers")
+	}
+}
+
+func TestGetChanged(t *testing.T) {
+	cfg = new(Config)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HdrETag, `"2"`)
+		if r.Header.Get(HdrIfNoneMatch) == `"2"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`{"Response":"Test message"}`))
+	}))
+	defer ts.Close()
+
+	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
+
+	err = cfg.Session.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, tag, err := cfg.Session.GetChanged("/", `"1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || tag != `"2"` {
+		t.Error("Bad response:", resp, tag)
+	}
+
+	resp, _, err = cfg.Session.GetChanged("/", tag)
+	if err != ErrNotModified {
+		t.Error("Expected ErrNotModified, got", err)
+	}
+	if len(resp) != 0 {
+		t.Error("Unexpected response:", resp)
+	}
+}
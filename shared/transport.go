@@ -3,9 +3,12 @@ package shared
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jfindley/skds/crypto"
@@ -101,10 +104,34 @@ func generateTLS(cfg *Config) *tls.Config {
 	return &config
 }
 
+// dialError is returned by customDialer, so that failures to connect to a
+// server can be told apart from errors once a request has been sent.
+type dialError struct {
+	error
+}
+
+// IsConnError returns true if err was caused by a failure to connect to the
+// server, complete the TLS handshake or verify its certificate.
+func IsConnError(err error) bool {
+	var d dialError
+	return errors.As(err, &d)
+}
+
 func customDialer(network, addr string, cfg *Config) (conn net.Conn, err error) {
+	conn, err = dialServer(network, addr, cfg)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, dialError{err}
+	}
+	return
+}
+
+func dialServer(network, addr string, cfg *Config) (conn net.Conn, err error) {
 	tlsCfg := generateTLS(cfg)
 
-	serverName, _, err := net.SplitHostPort(cfg.Startup.Address)
+	serverName, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return
 	}
@@ -140,7 +167,7 @@ func customDialer(network, addr string, cfg *Config) (conn net.Conn, err error)
 	// Really it'd be slightly more efficient to use the signature rather
 	// than the entire cert here, but using the entire cert makes testing
 	// much easier, and the space cost is pretty minimal.
-	err = checkSig(cfg, connState.PeerCertificates[0].Raw)
+	err = checkSig(cfg, addr, connState.PeerCertificates[0].Raw)
 	if err != nil {
 		err = errors.New("Error checking server signature: " + err.Error())
 		return
@@ -149,32 +176,60 @@ func customDialer(network, addr string, cfg *Config) (conn net.Conn, err error)
 	return
 }
 
-func checkSig(cfg *Config, sig []byte) (err error) {
+// checkSig compares the certificate of the server at addr with the one pinned
+// for that address, pinning it if this is the first time we have seen it.
+func checkSig(cfg *Config, addr string, sig []byte) (err error) {
 	// Disable signature checking.  This is for testing ONLY, and should
 	// never be done in production.
 	if cfg.Startup.Crypto.ServerCert == "" {
 		return nil
 	}
-	if cfg.Runtime.ServerCert == nil {
 
-		if _, err = os.Stat(cfg.Startup.Crypto.ServerCert); os.IsNotExist(err) {
+	pin, ok := cfg.Runtime.ServerCerts[addr]
+	if !ok {
+		file := pinFile(cfg, addr)
 
-			cfg.Runtime.ServerCert = sig
+		if _, err = os.Stat(file); os.IsNotExist(err) {
 
-			err = Write(&cfg.Runtime.ServerCert, cfg.Startup.Crypto.ServerCert)
-			return
+			pin = sig
+
+			err = Write(&pin, file)
+			if err != nil {
+				return
+			}
 		} else {
 
-			err = Read(&cfg.Runtime.ServerCert, cfg.Startup.Crypto.ServerCert)
+			err = Read(&pin, file)
 			if err != nil {
 				return
 			}
 
 		}
+
+		if cfg.Runtime.ServerCerts == nil {
+			cfg.Runtime.ServerCerts = make(map[string]crypto.Binary)
+		}
+		cfg.Runtime.ServerCerts[addr] = pin
 	}
 
-	if !cfg.Runtime.ServerCert.Compare(sig) {
-		return errors.New("Server signature does not match")
+	if !pin.Compare(sig) {
+		return fmt.Errorf("Server signature of %s does not match", addr)
 	}
 	return nil
 }
+
+// pinFile returns the file the certificate of the server at addr is pinned
+// in.  The server at Startup.Address uses the ServerCert file itself, so that
+// pins made before failover was configured remain valid.  Other servers use
+// a file named after their address alongside it.
+func pinFile(cfg *Config, addr string) string {
+	file := cfg.Startup.Crypto.ServerCert
+	if addr == cfg.Startup.Address {
+		return file
+	}
+
+	name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(addr)
+	ext := filepath.Ext(file)
+
+	return strings.TrimSuffix(file, ext) + "-" + name + ext
+}
@@ -3,8 +3,11 @@ package shared
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -71,7 +74,7 @@ func TestStart(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	cfg.Runtime.ServerCert = serverCert.Raw
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{cfg.Startup.Address: serverCert.Raw}
 	cfg.Startup.Crypto.ServerCert = "test"
 
 	srv := new(Server)
@@ -106,7 +109,7 @@ func TestCustomDialer(t *testing.T) {
 	defer ts.Close()
 
 	cfg.Startup.Address = strings.TrimPrefix(ts.URL, "https://")
-	cfg.Runtime.ServerCert = ts.TLS.Certificates[0].Certificate[0]
+	cfg.Runtime.ServerCerts = map[string]crypto.Binary{cfg.Startup.Address: ts.TLS.Certificates[0].Certificate[0]}
 
 	s := new(Session)
 	err = s.New(cfg)
@@ -122,3 +125,42 @@ func TestCustomDialer(t *testing.T) {
 		t.Error("Wrong status code:", resp.StatusCode)
 	}
 }
+
+func TestCheckSig(t *testing.T) {
+	cfg = new(Config)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "skds_pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.Startup.Address = "primary:8443"
+	cfg.Startup.Crypto.ServerCert = filepath.Join(dir, "server-signature.pem")
+
+	if f := pinFile(cfg, "primary:8443"); f != cfg.Startup.Crypto.ServerCert {
+		t.Error("Bad pin file for primary server:", f)
+	}
+	if f := pinFile(cfg, "backup:8443"); f != filepath.Join(dir, "server-signature-backup_8443.pem") {
+		t.Error("Bad pin file for backup server:", f)
+	}
+
+	err = checkSig(cfg, "primary:8443", []byte("primary cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSig(cfg, "backup:8443", []byte("backup cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pins are read back from disk by a new process.
+	cfg.Runtime.ServerCerts = nil
+
+	if checkSig(cfg, "primary:8443", []byte("primary cert")) != nil {
+		t.Error("Pinned certificate rejected")
+	}
+	if checkSig(cfg, "backup:8443", []byte("primary cert")) == nil {
+		t.Error("Certificate of another server accepted")
+	}
+}